@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+// RFC-8659 - 4.1 - CAA RDATA format
+type caa struct {
+	// Only the Issuer Critical Flag, bit 0, is defined
+	flags uint8
+	// `issue`, `issuewild` or `iodef`, at most 255 bytes
+	tag   string
+	value string
+}
+
+// The tag length is checked against the RDATA, the value takes whatever is
+// left
+func decodeCAA(data []byte) (*caa, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("Invalid CAA RDATA length: %d", len(data))
+	}
+
+	tagLength := int(data[1])
+
+	if tagLength == 0 {
+		return nil, fmt.Errorf("Invalid CAA tag: empty")
+	}
+
+	if 2+tagLength > len(data) {
+		return nil, fmt.Errorf("Invalid CAA tag length: %d, RDATA is %d bytes", tagLength, len(data))
+	}
+
+	return &caa{
+		flags: data[0],
+		tag:   string(data[2 : 2+tagLength]),
+		value: string(data[2+tagLength:]),
+	}, nil
+}
+
+func (c *caa) encode() ([]byte, error) {
+	if len(c.tag) == 0 || len(c.tag) > 255 {
+		return nil, fmt.Errorf("Invalid CAA tag length: %d", len(c.tag))
+	}
+
+	data := []byte{c.flags, byte(len(c.tag))}
+	data = append(data, c.tag...)
+	data = append(data, c.value...)
+
+	if len(data) > 0xFFFF {
+		return nil, fmt.Errorf("RDATA too long: %d bytes", len(data))
+	}
+
+	return data, nil
+}
+
+// RFC-8659 - 4.1.1 - `flags tag "value"`
+func (c *caa) String() string {
+	return fmt.Sprintf("%d %s %s", c.flags, c.tag, strconv.Quote(c.value))
+}
+
+func rdataCAA(rr *RR) (*caa, bool) {
+	if rr.Type() != dnsmsg.CAA {
+		return nil, false
+	}
+
+	record, err := decodeCAA(rr.RDATA)
+	if err != nil {
+		return nil, false
+	}
+
+	return record, true
+}
+
+func setCAA(rr *RR, c *caa) error {
+	data, err := c.encode()
+	if err != nil {
+		return err
+	}
+
+	rr.SetType(dnsmsg.CAA)
+	rr.SetData(data)
+
+	return nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+// Answers from the resolver, kept for the lowest TTL among their records.
+// There is one cache per forwarder, shared by every listener.
+type answerCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[cacheKey]*cacheEntry
+	// Log the reason of every miss
+	logMisses bool
+	// nil unless metrics are served
+	metrics *metrics
+}
+
+type cacheKey struct {
+	// Lower case, names are compared case insensitively
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type cacheEntry struct {
+	answers   []*RR
+	authority []*RR
+	// The AD bit of the upstream response
+	authenticData uint8
+	// NOERROR or NXDOMAIN
+	rcode    uint8
+	storedAt time.Time
+	expires  time.Time
+	// Set when the last response could not be stored, to tell why the next
+	// lookup misses. Such an entry holds no records.
+	uncacheable cacheMissReason
+}
+
+type cacheMissReason uint8
+
+const (
+	// Never asked, or evicted
+	cacheMissCold cacheMissReason = iota + 1
+	cacheMissExpired
+	// A record of the response has a TTL of 0, RFC-1035 - 3.2.1
+	cacheMissZeroTTL
+	// A record of the response is not about the question or its CNAME chain
+	cacheMissOutOfBailiwick
+	// Negative response without a SOA to bound how long it holds, RFC-2308 - 5
+	cacheMissNoSOA
+	// Only NOERROR and NXDOMAIN responses are cached, RFC-2308 - 7
+	cacheMissErrorRCODE
+)
+
+var cacheMissReasonNames = map[cacheMissReason]string{
+	cacheMissCold:           "cold",
+	cacheMissExpired:        "expired",
+	cacheMissZeroTTL:        "zero-ttl",
+	cacheMissOutOfBailiwick: "out-of-bailiwick",
+	cacheMissNoSOA:          "no-soa",
+	cacheMissErrorRCODE:     "error-rcode",
+}
+
+func (r cacheMissReason) String() string {
+	return cacheMissReasonNames[r]
+}
+
+func newAnswerCache(capacity int, logMisses bool) *answerCache {
+	return &answerCache{
+		capacity:  capacity,
+		entries:   make(map[cacheKey]*cacheEntry),
+		logMisses: logMisses,
+	}
+}
+
+func newCacheKey(q *question) cacheKey {
+	return cacheKey{
+		name:   strings.ToLower(joinLabels(q.QNAME)),
+		qtype:  q.Type(),
+		qclass: q.Class(),
+	}
+}
+
+// Returns a copy of the cached records, with their TTL decremented by the
+// time spent in the cache
+func (c *answerCache) lookup(ctx context.Context, q *question) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := newCacheKey(q)
+	now := time.Now()
+
+	entry, ok := c.entries[key]
+
+	var reason cacheMissReason
+	var hit cacheEntry
+
+	switch {
+	case !ok:
+		reason = cacheMissCold
+	case entry.uncacheable != 0:
+		reason = entry.uncacheable
+	case !now.Before(entry.expires):
+		reason = cacheMissExpired
+		delete(c.entries, key)
+	default:
+		hit = cacheEntry{
+			answers:       copyRRs(entry.answers, entry.storedAt),
+			authority:     copyRRs(entry.authority, entry.storedAt),
+			authenticData: entry.authenticData,
+			rcode:         entry.rcode,
+			storedAt:      entry.storedAt,
+			expires:       entry.expires,
+		}
+
+		// A record down to a TTL of 0 is evicted rather than served, see
+		// RFC-1035 - 3.2.1
+		if hasZeroTTL(hit.answers) || hasZeroTTL(hit.authority) {
+			reason = cacheMissExpired
+			delete(c.entries, key)
+		}
+	}
+
+	if reason != 0 {
+		c.metrics.cacheMiss(reason)
+		trace(ctx, "Cache miss", "name", key.name, "type", dnsmsg.RRTypeName(key.qtype), "reason", reason)
+		if c.logMisses {
+			slog.InfoContext(ctx, "Cache miss", "name", key.name, "type", dnsmsg.RRTypeName(key.qtype), "reason", reason)
+		}
+		return nil, false
+	}
+
+	c.metrics.cacheHit()
+	trace(ctx, "Cache hit", "name", key.name, "type", dnsmsg.RRTypeName(key.qtype))
+
+	return &hit, true
+}
+
+// Stores the upstream response to a question.
+// A response that cannot be cached is remembered as such, so the next miss
+// tells why.
+func (c *answerCache) store(q *question, response *message) {
+	entry := cacheEntry{
+		authenticData: response.header.AD(),
+		rcode:         response.header.RCODE(),
+		storedAt:      time.Now(),
+	}
+
+	ttl, reason := cacheableTTL(q, response)
+	if reason != 0 {
+		entry.uncacheable = reason
+	} else {
+		entry.answers = copyRRs(response.answer, entry.storedAt)
+		if len(response.answer) == 0 {
+			entry.authority = copyRRs(response.authority, entry.storedAt)
+		}
+		entry.expires = entry.storedAt.Add(time.Duration(ttl) * time.Second)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := newCacheKey(q)
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.capacity {
+		c.evict(entry.storedAt)
+	}
+
+	c.entries[key] = &entry
+}
+
+// Makes room for one entry. Expired entries go first, then the one closest
+// to expiring. Entries only recording a miss reason expire right away.
+// Must be called with the lock held
+func (c *answerCache) evict(now time.Time) {
+	var oldest cacheKey
+	var oldestExpires time.Time
+	found := false
+
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+			continue
+		}
+
+		if !found || entry.expires.Before(oldestExpires) {
+			oldest = key
+			oldestExpires = entry.expires
+			found = true
+		}
+	}
+
+	if found && len(c.entries) >= c.capacity {
+		delete(c.entries, oldest)
+	}
+}
+
+// The lowest TTL among the records of the response.
+// Negative responses hold for the SOA MINIMUM, bounded by the SOA TTL, see
+// RFC-2308 - 5.
+func cacheableTTL(q *question, response *message) (uint32, cacheMissReason) {
+	if rcode := response.header.RCODE(); rcode != dnsmsg.NOERROR && rcode != dnsmsg.NXDOMAIN {
+		return 0, cacheMissErrorRCODE
+	}
+
+	if len(response.answer) == 0 {
+		for _, rr := range response.authority {
+			record, ok := rdataSOA(rr)
+			if !ok {
+				continue
+			}
+
+			ttl := min(rr.TTLSeconds(), record.minimum)
+			if ttl == 0 {
+				return 0, cacheMissZeroTTL
+			}
+
+			return ttl, 0
+		}
+
+		return 0, cacheMissNoSOA
+	}
+
+	// Names the answers may be about: the question and its CNAME chain,
+	// in the order the resolver gave them
+	names := map[string]bool{strings.ToLower(joinLabels(q.QNAME)): true}
+
+	ttl := response.answer[0].TTLSeconds()
+
+	for _, rr := range response.answer {
+		if !names[strings.ToLower(joinLabels(rr.NAME))] {
+			return 0, cacheMissOutOfBailiwick
+		}
+
+		if target, ok := rdataCNAME(rr); ok {
+			names[strings.ToLower(joinLabels(target))] = true
+		}
+
+		ttl = min(ttl, rr.TTLSeconds())
+	}
+
+	if ttl == 0 {
+		return 0, cacheMissZeroTTL
+	}
+
+	return ttl, 0
+}
+
+// Records are mutated on their way out, TTL overrides for instance, the
+// cache never hands out the ones it holds.
+// The copies have the TTL left since `storedAt`, which is what gets
+// serialized.
+func copyRRs(rrs []*RR, storedAt time.Time) []*RR {
+	copied := make([]*RR, 0, len(rrs))
+
+	for _, rr := range rrs {
+		rrCopy := *rr
+		rrCopy.SetTTL(remainingTTL(rr, storedAt))
+		copied = append(copied, &rrCopy)
+	}
+
+	return copied
+}
+
+func hasZeroTTL(rrs []*RR) bool {
+	for _, rr := range rrs {
+		if rr.TTLSeconds() == 0 {
+			return true
+		}
+	}
+
+	return false
+}
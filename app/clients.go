@@ -0,0 +1,137 @@
+package main
+
+import (
+	"log/slog"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Per-client query counters, to spot a misbehaving client.
+// This is observability only, nothing is dropped.
+//
+// Counts are kept for the current and the previous window. The rate over the
+// last window is estimated by weighting the previous window by how much of
+// it still overlaps with the sliding window, which keeps the memory bounded
+// to the clients seen in the last two windows.
+type clientCounter struct {
+	mu          sync.Mutex
+	window      time.Duration
+	threshold   uint64
+	windowStart time.Time
+	current     map[netip.Addr]*clientCount
+	previous    map[netip.Addr]*clientCount
+}
+
+type clientCount struct {
+	queries uint64
+	// Only warn once per window per client
+	warned bool
+}
+
+type clientRate struct {
+	client  netip.Addr
+	queries uint64
+}
+
+func newClientCounter(window time.Duration, threshold uint64) *clientCounter {
+	return &clientCounter{
+		window:      window,
+		threshold:   threshold,
+		windowStart: time.Now(),
+		current:     make(map[netip.Addr]*clientCount),
+		previous:    make(map[netip.Addr]*clientCount),
+	}
+}
+
+func (c *clientCounter) rotate(now time.Time) {
+	elapsed := now.Sub(c.windowStart)
+
+	if elapsed < c.window {
+		return
+	}
+
+	if elapsed < 2*c.window {
+		c.previous = c.current
+		c.windowStart = c.windowStart.Add(c.window)
+	} else {
+		c.previous = make(map[netip.Addr]*clientCount)
+		c.windowStart = now
+	}
+
+	c.current = make(map[netip.Addr]*clientCount)
+}
+
+// Must be called with the lock held
+func (c *clientCounter) estimate(client netip.Addr, now time.Time) uint64 {
+	var queries uint64
+	if count, ok := c.current[client]; ok {
+		queries = count.queries
+	}
+
+	if count, ok := c.previous[client]; ok {
+		overlap := 1 - float64(now.Sub(c.windowStart))/float64(c.window)
+		queries += uint64(float64(count.queries) * overlap)
+	}
+
+	return queries
+}
+
+func (c *clientCounter) record(client netip.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.rotate(now)
+
+	count, ok := c.current[client]
+	if !ok {
+		count = new(clientCount)
+		c.current[client] = count
+	}
+
+	count.queries++
+
+	if c.threshold == 0 || count.warned {
+		return
+	}
+
+	if rate := c.estimate(client, now); rate > c.threshold {
+		count.warned = true
+		slog.Warn("Client exceeds query threshold", "client", client, "queries", rate, "window", c.window)
+	}
+}
+
+// The n clients with the most queries over the last window
+func (c *clientCounter) top(n int) []clientRate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.rotate(now)
+
+	rates := make([]clientRate, 0, len(c.current)+len(c.previous))
+	seen := make(map[netip.Addr]bool)
+
+	for _, section := range []map[netip.Addr]*clientCount{c.current, c.previous} {
+		for client := range section {
+			if seen[client] {
+				continue
+			}
+
+			seen[client] = true
+			rates = append(rates, clientRate{client: client, queries: c.estimate(client, now)})
+		}
+	}
+
+	sort.Slice(rates, func(i, j int) bool {
+		return rates[i].queries > rates[j].queries
+	})
+
+	if len(rates) > n {
+		rates = rates[:n]
+	}
+
+	return rates
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// The busiest clients are counted without a warning threshold
+func TestClientCounterWithoutThreshold(t *testing.T) {
+	c := newClientCounter(time.Minute, 0)
+
+	busy := netip.MustParseAddr("192.0.2.1")
+	quiet := netip.MustParseAddr("192.0.2.2")
+
+	for i := 0; i < 3; i++ {
+		c.record(busy)
+	}
+	c.record(quiet)
+
+	top := c.top(1)
+	if len(top) != 1 || top[0].client != busy || top[0].queries != 3 {
+		t.Fatalf("top clients = %v, want %v with 3 queries", top, busy)
+	}
+}
@@ -0,0 +1,9 @@
+package main
+
+import "github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+
+// RFC-1035 - 4.1.4 - Message compression
+// `serialize` writes every name in full.
+func (m *message) serializeCompressed() ([]byte, error) {
+	return dnsmsg.MarshalCompressed(m.wire())
+}
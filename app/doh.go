@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// RFC-8484 - DNS over HTTPS
+// The query is POSTed in wire format, the response body is the answer in
+// wire format as well.
+const dohContentType = "application/dns-message"
+
+// Only the path of a DoH resolver given without one
+const defaultDoHPath = "/dns-query"
+
+// Shared by every query to the upstream, connections are kept alive
+// between them
+func newDoHClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	transport.MaxIdleConnsPerHost = 16
+
+	return &http.Client{Transport: transport}
+}
+
+// `dns.google/dns-query`, the scheme is already cut off
+func parseDoHAddress(address string) (string, error) {
+	parsed, err := url.Parse("https://" + address)
+	if err != nil {
+		return "", err
+	}
+
+	if parsed.Host == "" {
+		return "", fmt.Errorf("missing host in DoH resolver: %s", address)
+	}
+
+	if parsed.Path == "" {
+		parsed.Path = defaultDoHPath
+	}
+
+	return parsed.Host + parsed.Path, nil
+}
+
+type httpsTransport struct {
+	// Host and path, without the scheme
+	address string
+	client  *http.Client
+}
+
+func (t *httpsTransport) attempt(ctx context.Context, query *message, deadline time.Time, bufSize uint16, stats *metrics) (*message, error) {
+	// RFC-8484 - 4.1 - An ID of 0 lets HTTP caches share responses, the
+	// request and its response are already paired by HTTP
+	query.header.SetID(0)
+
+	serialized, err := query.serialize()
+	if err != nil {
+		return nil, err
+	}
+
+	sent := time.Now()
+
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+t.address, bytes.NewReader(serialized))
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Content-Type", dohContentType)
+	request.Header.Set("Accept", dohContentType)
+
+	trace(ctx, "Forwarded question", "questions", query.questionNames(), "upstream", "https://"+t.address)
+
+	response, err := t.client.Do(request)
+	if errors.Is(err, context.DeadlineExceeded) {
+		// Retried as a UDP timeout would be
+		return nil, fmt.Errorf("Resolver did not answer within %s: err = %w", time.Since(sent).Round(time.Millisecond), os.ErrDeadlineExceeded)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query resolver: err = %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Resolver answered HTTP %s", response.Status)
+	}
+
+	if contentType := response.Header.Get("Content-Type"); contentType != dohContentType {
+		return nil, fmt.Errorf("Resolver answered with content type %q", contentType)
+	}
+
+	// A DNS message is at most 65535 bytes, as over TCP
+	body, err := io.ReadAll(io.LimitReader(response.Body, 0xFFFF))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read response from resolver: err = %w", err)
+	}
+
+	resolverResponse, err := deserialize(body)
+	if err != nil {
+		stats.upstreamParseFailure()
+		return nil, fmt.Errorf("Failed to parse response from resolver")
+	}
+
+	if resolverResponse.header.QR() != 1 {
+		return nil, fmt.Errorf("Resolver answered with a frame that is not a response")
+	}
+
+	return resolverResponse, nil
+}
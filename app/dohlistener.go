@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+// RFC-8484 - DNS over HTTPS, served on `--doh-listen`.
+// Queries go through the same pipeline as over UDP and TCP, only the framing
+// differs. TLS is terminated here with `--doh-cert` and `--doh-key`, or by a
+// reverse proxy in front of us.
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var frame []byte
+	var err error
+
+	switch r.Method {
+	// RFC-8484 - 4.1 - The query is base64url encoded, without padding
+	case http.MethodGet:
+		frame, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil || len(frame) == 0 {
+			http.Error(w, "Invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		// One extra byte to tell an oversized query, as over UDP
+		frame, err = io.ReadAll(io.LimitReader(r.Body, int64(s.maxQuerySize)+1))
+		if err != nil {
+			http.Error(w, "Failed to read the query", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if len(frame) > s.maxQuerySize {
+		http.Error(w, "Query too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var client net.Addr
+	if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		client = net.TCPAddrFromAddrPort(addrPort)
+
+		if s.clients != nil {
+			s.clients.record(addrPort.Addr().Unmap())
+		}
+	}
+
+	serialized, response := s.serveFrame(frame, client, false)
+	if serialized == nil {
+		http.Error(w, "Failed to answer the query", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+	w.Header().Set("Cache-Control", cacheControl(response))
+	w.Write(serialized)
+}
+
+// RFC-8484 - 5.1 - The response is fresh as long as its records are, the
+// SOA of negative responses included. Failures are not cached.
+func cacheControl(response *message) string {
+	rcode := response.header.RCODE()
+	if rcode != dnsmsg.NOERROR && rcode != dnsmsg.NXDOMAIN {
+		return "no-store"
+	}
+
+	records := append(append([]*RR{}, response.answer...), response.authority...)
+	if len(records) == 0 {
+		return "no-store"
+	}
+
+	ttl := records[0].TTLSeconds()
+	for _, rr := range records {
+		ttl = min(ttl, rr.TTLSeconds())
+	}
+
+	return fmt.Sprintf("max-age=%d", ttl)
+}
+
+// Runs alongside the DNS listeners, on `/dns-query`
+func (s *server) serveDoH(listener net.Listener, certFile string, keyFile string) {
+	mux := http.NewServeMux()
+	mux.Handle(defaultDoHPath, s)
+
+	// Slow clients must not hold connections open forever, as over TCP
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: streamIdleTimeout,
+		ReadTimeout:       streamIdleTimeout,
+		IdleTimeout:       streamIdleTimeout,
+	}
+
+	var err error
+	if certFile != "" {
+		err = srv.ServeTLS(listener, certFile, keyFile)
+	} else {
+		err = srv.Serve(listener)
+	}
+
+	if err != nil {
+		slog.Error("DoH listener stopped", "err", err)
+	}
+}
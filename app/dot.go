@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// RFC-7858 - DNS over TLS
+// The query is framed as over TCP, RFC-1035 - 4.2.2, inside a TLS session.
+// The resolver certificate is checked against the name given after `#`,
+// `tls://1.1.1.1#cloudflare-dns.com`, or against its IP address.
+const defaultTLSPort = "853"
+
+func newTLSConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+type tlsTransport struct {
+	// host:port
+	address string
+	config  *tls.Config
+}
+
+// One connection per attempt, as with UDP
+func (t *tlsTransport) attempt(ctx context.Context, query *message, deadline time.Time, bufSize uint16, stats *metrics) (*message, error) {
+	sent := time.Now()
+
+	dialer := tls.Dialer{
+		NetDialer: &net.Dialer{Deadline: deadline},
+		Config:    t.config,
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", t.address)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to resolver: err = %w", err)
+	}
+	defer conn.Close()
+
+	return exchangeOverStream(ctx, conn, query, deadline, sent, "tls://"+t.address, stats)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+// RFC-6891 - 6.1.2 - OPT pseudo-RR
+// The CLASS field holds the UDP payload size the sender can reassemble.
+// 1232 avoids IP fragmentation on virtually every path, see DNS flag day 2020.
+const (
+	defaultEDNSBufSize uint16 = 1232
+	minEDNSBufSize     uint16 = 512
+)
+
+func newOPT(udpPayloadSize uint16) *RR {
+	opt := new(RR)
+
+	opt.NAME = []string{}
+	opt.SetType(dnsmsg.OPT)
+	opt.SetClass(udpPayloadSize)
+	// Extended RCODE, version 0 and no flags
+	opt.SetTTL(0)
+	opt.SetData([]byte{})
+
+	return opt
+}
+
+// RFC-6891 - 6.1.2 - Options are {OPTION-CODE, OPTION-LENGTH, OPTION-DATA}
+type ednsOption struct {
+	code uint16
+	data []byte
+}
+
+// RFC-7873 - 4 - DNS Cookies
+const cookieOption uint16 = 10
+
+func (m *message) opts() []*RR {
+	opts := make([]*RR, 0, 1)
+
+	for _, rr := range m.additional {
+		if rr.Type() == dnsmsg.OPT {
+			opts = append(opts, rr)
+		}
+	}
+
+	return opts
+}
+
+// RFC-6891 - 6.2.3 - The UDP payload size advertised in the OPT record.
+// Values below 512 are treated as 512, false when there is no OPT record.
+func (m *message) udpPayloadSize() (uint16, bool) {
+	opts := m.opts()
+
+	if len(opts) == 0 {
+		return 0, false
+	}
+
+	return max(binary.BigEndian.Uint16(opts[0].CLASS[:]), minEDNSBufSize), true
+}
+
+func decodeEDNSOptions(rdata []byte) ([]ednsOption, error) {
+	options := make([]ednsOption, 0)
+
+	for head := 0; head < len(rdata); {
+		if head+4 > len(rdata) {
+			return nil, fmt.Errorf("truncated EDNS option")
+		}
+
+		code := binary.BigEndian.Uint16(rdata[head : head+2])
+		length := int(binary.BigEndian.Uint16(rdata[head+2 : head+4]))
+		head += 4
+
+		if head+length > len(rdata) {
+			return nil, fmt.Errorf("truncated EDNS option %d", code)
+		}
+
+		options = append(options, ednsOption{code: code, data: rdata[head : head+length]})
+		head += length
+	}
+
+	return options, nil
+}
+
+func encodeEDNSOptions(options []ednsOption) []byte {
+	data := make([]byte, 0)
+
+	for _, option := range options {
+		data = binary.BigEndian.AppendUint16(data, option.code)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(option.data)))
+		data = append(data, option.data...)
+	}
+
+	return data
+}
+
+// RFC-6891 - 7 - A query with an OPT record gets one in the response,
+// whoever answers it. Otherwise EDNS-enabled clients may reject it.
+// The client cookie is echoed, we do not generate server cookies.
+func (m *message) addOPTFor(query *message, udpPayloadSize uint16) error {
+	opts := query.opts()
+
+	if len(opts) == 0 {
+		return nil
+	}
+
+	// RFC-6891 - 6.1.1 - More than one OPT is a format error
+	if len(opts) > 1 {
+		return fmt.Errorf("query has %d OPT records", len(opts))
+	}
+
+	options, err := decodeEDNSOptions(opts[0].RDATA)
+	if err != nil {
+		return err
+	}
+
+	opt := newOPT(udpPayloadSize)
+
+	for _, option := range options {
+		// RFC-7873 - 5.2 - Only the 8 bytes of client cookie are ours to echo
+		if option.code == cookieOption && len(option.data) >= 8 {
+			opt.SetData(encodeEDNSOptions([]ednsOption{{code: cookieOption, data: option.data[:8]}}))
+		}
+	}
+
+	m.additional = append(m.additional, opt)
+	m.header.SetARCOUNT(uint16(len(m.additional)))
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Identical questions asked at the same time share a single upstream
+// exchange, as `golang.org/x/sync/singleflight` would do.
+// CD questions are kept apart, their responses did not go through
+// validation.
+type flightKey struct {
+	cacheKey
+	checkingDisabled uint8
+}
+
+type flight struct {
+	// Closed once the exchange is over
+	done     chan struct{}
+	response *message
+	err      error
+}
+
+// The zero value is ready to use
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[flightKey]*flight
+}
+
+// Runs `exchange` unless the same question is already in flight, in which
+// case it waits for that one instead. The response is shared between the
+// callers, it must not be mutated.
+// Waiters give up with their own context, the exchange goes on for the others.
+func (g *flightGroup) do(ctx context.Context, key flightKey, exchange func() (*message, error)) (*message, bool, error) {
+	g.mu.Lock()
+
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+
+		select {
+		case <-f.done:
+			return f.response, true, f.err
+		case <-ctx.Done():
+			return nil, true, ctx.Err()
+		}
+	}
+
+	if g.flights == nil {
+		g.flights = make(map[flightKey]*flight)
+	}
+
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+
+	g.mu.Unlock()
+
+	f.response, f.err = exchange()
+
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+
+	close(f.done)
+
+	return f.response, false, f.err
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+func TestConcurrentQuestionsShareOneExchange(t *testing.T) {
+	// Slow enough for every query to arrive while the first is in flight
+	stub := startStubResolver(t, func(query *message) *message {
+		time.Sleep(100 * time.Millisecond)
+		return answerA(query)
+	})
+
+	f := newTestForwarder(t, stub.addr)
+
+	const clients = 20
+
+	var wg sync.WaitGroup
+	errs := make([]error, clients)
+	answers := make([]int, clients)
+
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			result, err := f.forwardResolve(context.Background(), newTestQuery(uint16(i), "example.com", dnsmsg.A).question, 0, 1)
+			errs[i] = err
+			if err == nil {
+				answers[i] = len(result.answers)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	for i := range errs {
+		if errs[i] != nil || answers[i] != 1 {
+			t.Errorf("Client %d: expected 1 answer, got %d, err = %v", i, answers[i], errs[i])
+		}
+	}
+
+	if got := stub.queries.Load(); got != 1 {
+		t.Errorf("Expected a single upstream query, got %d", got)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+// Address records we know locally, by lowercased name.
+// Used to fill the additional section with the addresses of the names
+// our answers point to, sparing the client a round trip.
+type addressBook map[string][]*RR
+
+func (b addressBook) add(rr *RR) {
+	name := strings.ToLower(joinLabels(rr.NAME))
+	b[name] = append(b[name], rr)
+}
+
+// The name an NS/MX/SRV record points to.
+// RDATA is never compressed, the names of decoded records are decompressed.
+func glueTarget(rr *RR) ([]string, bool) {
+	switch rr.Type() {
+	case dnsmsg.NS:
+		return rdataNS(rr)
+	case dnsmsg.MX:
+		_, exchange, ok := rdataMX(rr)
+		return exchange, ok
+	// RFC-2782 - Priority, Weight & Port
+	case dnsmsg.SRV:
+		labels, end, ok := rdataLabels(rr.RDATA, 6)
+		return labels, ok && end == len(rr.RDATA)
+	default:
+		return nil, false
+	}
+}
+
+func (m *message) addGlue(book addressBook) {
+	added := make(map[string]bool)
+
+	for _, a := range m.answer {
+		target, ok := glueTarget(a)
+		if !ok {
+			continue
+		}
+
+		name := strings.ToLower(joinLabels(target))
+		if added[name] {
+			continue
+		}
+
+		added[name] = true
+		m.additional = append(m.additional, book[name]...)
+	}
+
+	m.header.SetARCOUNT(uint16(len(m.additional)))
+}
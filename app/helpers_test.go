@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+// Messages are compared as a client reads them: header fields, questions,
+// then every record in the master file format of `rrString`, RDATA decoded.
+func messageLines(m *message) []string {
+	h := m.header
+	lines := []string{fmt.Sprintf("header id=%d qr=%d opcode=%d aa=%d tc=%d rd=%d ra=%d ad=%d cd=%d rcode=%d",
+		h.ID(), h.QR(), h.OPCODE(), h.AA(), h.TC(), h.RD(), h.RA(), h.AD(), h.CD(), h.RCODE())}
+
+	for _, q := range m.question {
+		lines = append(lines, fmt.Sprintf("question %s %s %s", joinLabels(q.QNAME), dnsmsg.ClassName(q.Class()), dnsmsg.RRTypeName(q.Type())))
+	}
+
+	sections := []struct {
+		name string
+		rrs  []*RR
+	}{{"answer", m.answer}, {"authority", m.authority}, {"additional", m.additional}}
+
+	for _, section := range sections {
+		for _, rr := range section.rrs {
+			lines = append(lines, section.name+" "+rrString(rr))
+		}
+	}
+
+	return lines
+}
+
+// Empty when both messages read the same, otherwise every line of both,
+// the differing ones marked with - for `want` and + for `got`
+func diffMessages(want *message, got *message) string {
+	wantLines := messageLines(want)
+	gotLines := messageLines(got)
+
+	var diff strings.Builder
+	differs := false
+
+	for i := 0; i < max(len(wantLines), len(gotLines)); i++ {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+
+		if w == g {
+			fmt.Fprintf(&diff, "  %s\n", w)
+			continue
+		}
+
+		differs = true
+		if w != "" {
+			fmt.Fprintf(&diff, "- %s\n", w)
+		}
+		if g != "" {
+			fmt.Fprintf(&diff, "+ %s\n", g)
+		}
+	}
+
+	if !differs {
+		return ""
+	}
+
+	return diff.String()
+}
+
+func assertMessage(t *testing.T, want *message, got *message) {
+	t.Helper()
+
+	if diff := diffMessages(want, got); diff != "" {
+		t.Errorf("messages differ (-want +got):\n%s", diff)
+	}
+}
+
+// A query for `name` as a stub resolver would send it, RD set
+func newTestQuery(id uint16, name string, qtype uint16) *message {
+	q := &question{QNAME: splitName(name)}
+	q.SetType(qtype)
+	q.SetClass(dnsmsg.IN)
+
+	m := &message{header: new(header), question: []*question{q}}
+	m.header.SetID(id)
+	m.header.SetRD(1)
+	m.header.SetQDCOUNT(1)
+
+	return m
+}
+
+func newTestRR(name string, rrtype uint16, ttl uint32, data []byte) *RR {
+	rr := &RR{NAME: splitName(name)}
+	rr.SetType(rrtype)
+	rr.SetClass(dnsmsg.IN)
+	rr.SetTTL(ttl)
+	rr.SetData(data)
+
+	return rr
+}
+
+// Answers every query on a local UDP socket with `answer`, which returns
+// the response to send or nil to leave the query unanswered.
+// Counts the queries it received, answered or not.
+type stubResolver struct {
+	addr    string
+	queries atomic.Int32
+}
+
+func startStubResolver(t *testing.T, answer func(query *message) *message) *stubResolver {
+	t.Helper()
+
+	return startStubResolverFrames(t, func(query *message) [][]byte {
+		response := answer(query)
+		if response == nil {
+			return nil
+		}
+
+		serialized, err := response.serialize()
+		if err != nil {
+			return nil
+		}
+
+		return [][]byte{serialized}
+	})
+}
+
+// As `startStubResolver`, with every datagram sent back in order, so that
+// forged ones can go out before the real response
+func startStubResolverFrames(t *testing.T, answer func(query *message) [][]byte) *stubResolver {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to start stub resolver: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	stub := &stubResolver{addr: conn.LocalAddr().String()}
+
+	go func() {
+		buf := make([]byte, 0xFFFF)
+
+		for {
+			size, client, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			stub.queries.Add(1)
+
+			query, err := deserialize(buf[:size])
+			if err != nil {
+				continue
+			}
+
+			for _, frame := range answer(query) {
+				conn.WriteToUDP(frame, client)
+			}
+		}
+	}()
+
+	return stub
+}
+
+// Answers with an A record of 192.0.2.1 for every question
+func answerA(query *message) *message {
+	response := createResponseMessage(query)
+	response.header.SetRA(1)
+
+	for _, q := range query.question {
+		response.answer = append(response.answer, newTestRR(joinLabels(q.QNAME), dnsmsg.A, 300, []byte{192, 0, 2, 1}))
+	}
+
+	return response
+}
+
+func answerRCODE(rcode uint8) func(query *message) *message {
+	return func(query *message) *message {
+		response := createResponseMessage(query)
+		response.header.SetRA(1)
+		response.header.SetRCODE(rcode)
+
+		return response
+	}
+}
+
+// Never answers
+func answerNothing(query *message) *message {
+	return nil
+}
+
+// A forwarder to the stub resolvers with short timeouts, tried in order
+func newTestForwarder(t *testing.T, addrs ...string) *forwarder {
+	t.Helper()
+
+	f := &forwarder{
+		ednsBufSize: defaultEDNSBufSize,
+		timeout:     200 * time.Millisecond,
+		budget:      defaultResolveBudget,
+		retries:     1,
+	}
+
+	for _, addr := range addrs {
+		spec, err := parseResolver(addr)
+		if err != nil {
+			t.Fatalf("Failed to parse resolver %s: %v", addr, err)
+		}
+
+		u, err := newUpstream(spec)
+		if err != nil {
+			t.Fatalf("Failed to set up resolver %s: %v", addr, err)
+		}
+
+		f.upstreams = append(f.upstreams, u)
+	}
+
+	return f
+}
+
+func newTestServer(f *forwarder) *server {
+	static := defaultStaticAnswer
+
+	return &server{
+		forwarder:    f,
+		maxQuerySize: defaultMaxQuerySize,
+		udpWorkers:   defaultUDPWorkers,
+		ednsBufSize:  defaultEDNSBufSize,
+		static:       &static,
+	}
+}
+
+// Runs the query through serialization and the whole server pipeline, as a
+// UDP client would see it
+func exchangeTest(t *testing.T, s *server, query *message) *message {
+	t.Helper()
+
+	return exchangeTestOver(t, s, query, true)
+}
+
+// As `exchangeTest`, over a stream when `udp` is false
+func exchangeTestOver(t *testing.T, s *server, query *message, udp bool) *message {
+	t.Helper()
+
+	frame, err := query.serialize()
+	if err != nil {
+		t.Fatalf("Failed to serialize query: %v", err)
+	}
+
+	serialized, _ := s.serveFrame(frame, nil, udp)
+	if serialized == nil {
+		t.Fatalf("No response to the query")
+	}
+
+	response, err := deserialize(serialized)
+	if err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	return response
+}
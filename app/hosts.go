@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Static answers per name, loaded with `--hosts-file`.
+// Names missing from the file are NXDOMAIN.
+type hostsTable map[string]*staticAnswer
+
+// Accepts both the `/etc/hosts` format, `address name [alias...]`, and
+// `name address [ttl]` lines. Without a TTL, `ttl` is used.
+// A name may have one IPv4 and one IPv6 address.
+// Names are checked against the preferred name syntax unless `anyLabel`.
+func parseHosts(data string, ttl uint32, anyLabel bool) (hostsTable, error) {
+	hosts := make(hostsTable)
+
+	for n, line := range strings.Split(data, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid hosts entry on line %d", n+1)
+		}
+
+		var names []string
+		entryTTL := ttl
+
+		ip, err := netip.ParseAddr(fields[0])
+		if err == nil {
+			names = fields[1:]
+		} else {
+			if len(fields) > 3 {
+				return nil, fmt.Errorf("invalid hosts entry on line %d", n+1)
+			}
+
+			names = fields[:1]
+
+			ip, err = netip.ParseAddr(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid address on line %d: %w", n+1, err)
+			}
+
+			if len(fields) == 3 {
+				parsed, err := strconv.ParseUint(fields[2], 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("invalid TTL on line %d: %w", n+1, err)
+				}
+				entryTTL = uint32(parsed)
+			}
+		}
+
+		for _, name := range names {
+			if !anyLabel {
+				err := checkHostname(splitName(name))
+				if err != nil {
+					return nil, fmt.Errorf("invalid name on line %d: %w", n+1, err)
+				}
+			}
+
+			hosts.add(name, ip.Unmap(), entryTTL)
+		}
+	}
+
+	return hosts, nil
+}
+
+func (h hostsTable) add(name string, ip netip.Addr, ttl uint32) {
+	key := strings.ToLower(strings.TrimSuffix(name, "."))
+
+	entry, ok := h[key]
+	if !ok {
+		entry = &staticAnswer{ttl: ttl}
+		h[key] = entry
+	}
+
+	if ip.Is4() {
+		entry.ipv4 = ip
+	} else {
+		entry.ipv6 = ip
+	}
+}
+
+func (h hostsTable) lookup(name []string) (*staticAnswer, bool) {
+	entry, ok := h[strings.ToLower(joinLabels(name))]
+	return entry, ok
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// On a multi-homed host bound to a wildcard address, the kernel picks the
+// source address of our replies from the routing table, which might not be
+// the address the query was sent to. Clients reject such replies.
+// We ask the kernel for the destination address of each incoming packet
+// and send the reply from that same address.
+type udpListener struct {
+	conn *net.UDPConn
+	v4   *ipv4.PacketConn
+	v6   *ipv6.PacketConn
+}
+
+func newUDPListener(conn *net.UDPConn) (*udpListener, error) {
+	listener := udpListener{conn: conn}
+
+	localAddr := conn.LocalAddr().(*net.UDPAddr)
+
+	if localAddr.IP.To4() != nil {
+		listener.v4 = ipv4.NewPacketConn(conn)
+
+		err := listener.v4.SetControlMessage(ipv4.FlagDst|ipv4.FlagInterface, true)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		listener.v6 = ipv6.NewPacketConn(conn)
+
+		err := listener.v6.SetControlMessage(ipv6.FlagDst|ipv6.FlagInterface, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &listener, nil
+}
+
+// Where a query came from and where it was sent to.
+// The reply goes back from `local` to `remote`.
+type udpSource struct {
+	remote  *net.UDPAddr
+	local   net.IP
+	ifIndex int
+}
+
+func (l *udpListener) readFrom(buf []byte) (int, *udpSource, error) {
+	source := new(udpSource)
+
+	var size int
+	var addr net.Addr
+	var err error
+
+	if l.v4 != nil {
+		var cm *ipv4.ControlMessage
+		size, cm, addr, err = l.v4.ReadFrom(buf)
+		if cm != nil {
+			source.local = cm.Dst
+			source.ifIndex = cm.IfIndex
+		}
+	} else {
+		var cm *ipv6.ControlMessage
+		size, cm, addr, err = l.v6.ReadFrom(buf)
+		if cm != nil {
+			source.local = cm.Dst
+			source.ifIndex = cm.IfIndex
+		}
+	}
+
+	if err != nil {
+		return size, nil, err
+	}
+
+	source.remote = addr.(*net.UDPAddr)
+
+	return size, source, nil
+}
+
+func (l *udpListener) writeTo(frame []byte, dst *udpSource) error {
+	var err error
+
+	if l.v4 != nil {
+		cm := ipv4.ControlMessage{Src: dst.local, IfIndex: dst.ifIndex}
+		_, err = l.v4.WriteTo(frame, &cm, dst.remote)
+	} else {
+		cm := ipv6.ControlMessage{Src: dst.local, IfIndex: dst.ifIndex}
+		_, err = l.v6.WriteTo(frame, &cm, dst.remote)
+	}
+
+	return err
+}
+
+func listenUDP(address string, buffers socketBuffers) (*udpListener, error) {
+	listenConfig := net.ListenConfig{Control: buffers.control}
+
+	packetConn, err := listenConfig.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	udpConn := packetConn.(*net.UDPConn)
+
+	buffers.logGranted(udpConn)
+
+	listener, err := newUDPListener(udpConn)
+	if err != nil {
+		udpConn.Close()
+		return nil, fmt.Errorf("Failed to enable packet info on the listener: err = %w", err)
+	}
+
+	return listener, nil
+}
+
+// Queries are handled by a pool of workers fed by the read loop, a slow
+// upstream only holds the workers waiting on it.
+const defaultUDPWorkers = 64
+
+type udpQuery struct {
+	// Copied out of the read buffer, which is reused for the next datagram.
+	// Back to `framePool` once answered.
+	frame  *[]byte
+	source *udpSource
+}
+
+func (s *server) serveUDP(listener *udpListener) {
+	queries := make(chan udpQuery, s.udpWorkers)
+	defer close(queries)
+
+	for i := 0; i < s.udpWorkers; i++ {
+		go s.udpWorker(listener, queries)
+	}
+
+	// One extra byte to tell a datagram of exactly the max size from a
+	// larger one the kernel truncated
+	buf := make([]byte, s.maxQuerySize+1)
+
+	for {
+		size, source, err := listener.readFrom(buf)
+		if err != nil {
+			slog.Error("Failed to receive data", "err", err)
+			break
+		}
+
+		if s.clients != nil {
+			s.clients.record(source.remote.AddrPort().Addr().Unmap())
+		}
+
+		// Blocks when every worker is busy, the kernel buffers the
+		// datagrams in the meantime
+		queries <- udpQuery{frame: getFrame(buf[:size]), source: source}
+	}
+}
+
+func (s *server) udpWorker(listener *udpListener, queries <-chan udpQuery) {
+	for query := range queries {
+		s.answerUDP(listener, query)
+		putFrame(query.frame)
+	}
+}
+
+func (s *server) answerUDP(listener *udpListener, query udpQuery) {
+	frame := *query.frame
+
+	var serialized []byte
+
+	if len(frame) > s.maxQuerySize {
+		serialized = formatError(frame)
+	} else {
+		serialized, _ = s.serveFrame(frame, query.source.remote, true)
+	}
+
+	if serialized == nil {
+		return
+	}
+
+	err := listener.writeTo(serialized, query.source)
+	if err != nil {
+		slog.Error("Failed to send response", "client", query.source.remote, "err", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+// Concurrent clients over a real UDP listener, each must get the response
+// to its own query while the read buffer is reused for the next datagrams.
+// Meant to run with `go test -race`.
+func TestConcurrentUDPQueries(t *testing.T) {
+	listener, err := listenUDP("127.0.0.1:0", socketBuffers{})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.conn.Close() })
+
+	s := newTestServer(nil)
+	s.udpWorkers = 4
+	go s.serveUDP(listener)
+
+	const clients = 50
+	errs := make([]error, clients)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = exchangeUDP(listener.conn.LocalAddr().String(), uint16(i), fmt.Sprintf("host%d.example.com", i))
+		}()
+	}
+
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Client %d: %v", i, err)
+		}
+	}
+}
+
+func exchangeUDP(addr string, id uint16, name string) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	frame, err := newTestQuery(id, name, dnsmsg.A).serialize()
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Write(frame); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	buf := make([]byte, maxUDPSize)
+	size, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+
+	response, err := deserialize(buf[:size])
+	if err != nil {
+		return err
+	}
+
+	if response.header.ID() != id || len(response.question) != 1 || joinLabels(response.question[0].QNAME) != name {
+		return fmt.Errorf("response to another query: ID %d for %v", response.header.ID(), response.questionNames())
+	}
+
+	return nil
+}
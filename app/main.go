@@ -1,545 +1,942 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
-	"math"
-	"math/rand/v2"
+	"log/slog"
 	"net"
 	"net/netip"
 	"os"
 	"strconv"
-)
-
-// TYPES
-const (
-	A uint16 = 1
-)
+	"strings"
+	"sync"
+	"time"
 
-// CLASSES
-const (
-	IN uint16 = 1
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
 )
 
-// OPCODES
-const (
-	QUERY uint8 = 0
-	// RFC-1034 and RFC-1035 only specify 3 OPCODEs: 0 QUERY, 1 IQUERY, and 2 STATUS.
-	// It reserves 3-15 for future use.
-	// RFC-1996 specifies `NOTIFY` as OPCODE 4 but we're only implementing
-	// a subset of RFC-1035 and use it for `UNIMPLEMENTED`.
-	UNIMPLEMENTED uint8 = 4
-)
-
-// See QNAME & NAME definitions in RFC-1035 - 4.1.2 as well as 2.3.1
-func encodeLabelSequence(labels []string) ([]byte, error) {
-	encodedLabelSequence := make([]byte, 0)
-
+// RFC-1035 - 2.3.1 - Preferred name syntax: labels made of letters, digits
+// and hyphens, not starting or ending with a hyphen.
+// Only names read from our own files are checked. RFC-2181 - 11 - On the
+// wire a label is any binary string, relayed names are written as received.
+func checkHostname(labels []string) error {
 	for _, label := range labels {
-		if len(label) > 63 {
-			return nil,
-				fmt.Errorf("Max len of a label is 63.")
+		if label == "" {
+			return fmt.Errorf("empty label in %q", strings.Join(labels, "."))
 		}
 
-		// Note: we never compress the labels
-		// The chosen solution of high level representation makes it
-		// hard to do proper compression and it is not required by our
-		// test suite.
-		encodedLabelSequence = append(encodedLabelSequence, byte(len(label)))
-		encodedLabelSequence = append(encodedLabelSequence, []byte(label)...)
-	}
-
-	encodedLabelSequence = append(encodedLabelSequence, byte(0))
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("label %q in %q starts or ends with a hyphen", label, strings.Join(labels, "."))
+		}
 
-	if len(encodedLabelSequence) > 255 {
-		return nil, fmt.Errorf("Max len of a label seq is 255.")
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+				return fmt.Errorf("label %q in %q has a character other than a letter, digit or hyphen", label, strings.Join(labels, "."))
+			}
+		}
 	}
 
-	return encodedLabelSequence, nil
+	return nil
 }
 
-// TODO replace by making use of bufio.reader
-// no nead to maintain our own head / offset
-func extractBytes(src []byte, offset *int, length int) []byte {
-	result := src[*offset : *offset+length]
-	*offset += length
-	return result
-}
+// Splits a dotted name, e.g. `codecrafters.io.`, into its labels.
+// The root is `.` and has no label.
+func splitName(name string) []string {
+	name = strings.TrimSuffix(name, ".")
 
-func extractUint16(src []byte, offset *int) ([2]byte, uint16) {
-	result := [2]byte{src[*offset], src[*offset+1]}
-	*offset += 2
-	return result, binary.BigEndian.Uint16(result[:])
-}
+	if name == "" {
+		return []string{}
+	}
 
-func extractUint32(src []byte, offset *int) ([4]byte, uint32) {
-	result := [4]byte{src[*offset], src[*offset+1], src[*offset+2], src[*offset+3]}
-	*offset += 4
-	return result, binary.BigEndian.Uint32(result[:])
+	return strings.Split(name, ".")
 }
 
 // RFC-1035 - 4.1 - Message Format
+// Read and written by the dnsmsg package, see `deserialize` and `wire`.
+// It is a type of its own for the methods the server declares on it.
 type message struct {
-	cache *labelCache
-
 	// SECTIONS
 	header   *header
 	question []*question
 	answer   []*answer
-	// unusupported by this server authority []*RR
-	// unusupported by this server
+	// Only forwarded from upstream responses
+	authority []*RR
+	// Glue and the EDNS0 OPT pseudo-RR
 	additional []*RR
 }
 
-// RFC-1035 4.1.4. Message compression
-// The architecture I have chosen makes it hard to implement compression properly.
-// Normally, it is a simple pointer to a previous label in the frame.
-// Paying the price for my early design decisions... Never abstract too early.
-// There are two major drawbacks:
-// 1. We cannot easily compress messages
-// 2. We cannot follow recursive pointers (rare as they may be)
-type labelCache struct {
-	// Map label to position
-	labelMap map[string]int
-	// Position to label
-	positionMap map[int]string
-}
-
-// When we have a reference to a previous label, we need to
-// include the label we encountered and each subsequent label
-// For example, consider the following situation
-// - `google` label starts at byte 12
-// - `com` label starts at byte 19
-// If later we encounter a reference to byte 12
-// we need to include fetch the entire label sequence that started at byte 12,
-// which is label `google` followed by label `com`
-func (c *labelCache) allSubsequentLabels(head int) []string {
-	labels := make([]string, 0)
+// The entries of the sections are used as dnsmsg declares them
+type (
+	header   = dnsmsg.Header
+	question = dnsmsg.Question
+	RR       = dnsmsg.RR
+	answer   = RR
+)
 
-	for {
-		if label, ok := c.positionMap[head]; ok {
-			labels = append(labels, label)
-			head += len(label) + 1
-			continue
-		}
+func deserialize(frame []byte) (*message, error) {
+	var m dnsmsg.Message
 
-		break
+	err := dnsmsg.Unmarshal(frame, &m)
+	if err != nil {
+		return nil, err
 	}
 
-	return labels
+	return &message{
+		header:     m.Header,
+		question:   m.Question,
+		answer:     m.Answer,
+		authority:  m.Authority,
+		additional: m.Additional,
+	}, nil
 }
 
-func decodeLabels(frame []byte, head *int, cache *labelCache) ([]string, error) {
-	labels := make([]string, 0)
+func (m *message) questionNames() []string {
+	return questionNames(m.question)
+}
 
-	for {
-		if frame[*head] == 0 {
-			*head++
-			break
-		}
+func (m *message) questionTypes() []string {
+	return questionTypes(m.question)
+}
 
-		if frame[*head] == 192 {
-			pointer := int(frame[*head+1])
+func questionNames(questions []*question) []string {
+	names := make([]string, 0, len(questions))
 
-			referencedLabels := cache.allSubsequentLabels(pointer)
+	for _, q := range questions {
+		names = append(names, joinLabels(q.QNAME))
+	}
 
-			if len(referencedLabels) == 0 {
-				return labels, fmt.Errorf("Invalid label reference: %d", frame[*head+1])
-			}
+	return names
+}
 
-			labels = append(labels, referencedLabels...)
+func questionTypes(questions []*question) []string {
+	types := make([]string, 0, len(questions))
 
-			*head += 2
-			break
+	for _, q := range questions {
+		types = append(types, dnsmsg.RRTypeName(q.Type()))
+	}
+
+	return types
+}
+
+func (m *message) hasZoneTransfer() bool {
+	for _, q := range m.question {
+		if q.Type() == dnsmsg.AXFR || q.Type() == dnsmsg.IXFR {
+			return true
 		}
+	}
+
+	return false
+}
 
-		labelLen := int(frame[*head])
-		labelPosition := *head
-		*head += 1
+func createResponseMessage(initialMessage *message) *message {
+	header := new(header)
 
-		label := string(extractBytes(frame, head, labelLen))
+	questions := make([]*question, 0, initialMessage.header.QDCOUNT())
+	answers := make([]*answer, 0, initialMessage.header.QDCOUNT())
 
-		cache.labelMap[label] = labelPosition
-		cache.positionMap[labelPosition] = label
-		labels = append(labels, label)
+	copy(header[:], initialMessage.header[:])
+
+	header.SetQR(1)
+	// RFC-1035 - 4.1.1 - ID is copied into the reply, the client matches it
+	// against its query. Forwarded answers come from upstream messages with
+	// IDs of their own, only their records are copied, never their header.
+	header.SetID(initialMessage.header.ID())
+	// RFC-1035 - 4.1.1 - RD is copied from the query into the response
+	header.SetRD(initialMessage.header.RD())
+	header.SetAA(0)
+	header.SetTC(0)
+	header.SetRA(0)
+	header.SetZ(0)
+	// We validate nothing ourselves. AD is only set when forwarding data the
+	// upstream resolver authenticated, CD is echoed, see RFC-6840 - 5.7 & 5.8.
+	header.SetAD(0)
+	header.SetCD(initialMessage.header.CD())
+
+	// RFC-1035 - 4.1.1 - OPCODE is copied from the query into the response
+	header.SetOPCODE(initialMessage.header.OPCODE())
+	if initialMessage.header.OPCODE() == dnsmsg.QUERY {
+		header.SetRCODE(dnsmsg.NOERROR)
+	} else {
+		header.SetRCODE(dnsmsg.NOTIMP)
 	}
 
-	return labels, nil
-}
+	for i := uint16(0); i < initialMessage.header.QDCOUNT(); i++ {
+		question := new(question)
 
-func deserialize(frame []byte) (*message, error) {
-	cache := labelCache{
-		labelMap:    make(map[string]int),
-		positionMap: make(map[int]string),
+		question.QNAME = initialMessage.question[i].QNAME
+		question.QTYPE = initialMessage.question[i].QTYPE
+		question.QCLASS = initialMessage.question[i].QCLASS
+
+		questions = append(questions, question)
 	}
 
-	// HEADER
-	header := new(header)
-	copied := copy(header.bytes[:], frame)
+	header.SetQDCOUNT(uint16(len(questions)))
+	header.SetANCOUNT(0)
+	header.SetNSCOUNT(0)
+	header.SetARCOUNT(0)
 
-	if copied < 12 {
-		return nil, fmt.Errorf("invalid DNS header")
+	response := message{
+		header:   header,
+		question: questions,
+		answer:   answers,
 	}
 
-	// QUESTION
-	questions := make([]*question, 0, header.QDCOUNT())
-	head := 12
+	return &response
+}
 
-	for i := uint16(0); i < header.QDCOUNT(); i++ {
-		question := new(question)
+type forwarder struct {
+	// Tried in order, the next one is only asked when the previous one
+	// timed out or answered SERVFAIL
+	upstreams []*upstream
+	// Advertised to the resolver in our OPT record.
+	// It is also the size of the buffer we read responses with, a resolver
+	// may send up to that many bytes.
+	ednsBufSize uint16
+	// nil unless caching is enabled
+	cache *answerCache
+	// How long we wait for an upstream before moving on to the next one
+	timeout time.Duration
+	// Overall deadline to resolve a single question, shared by the upstreams
+	budget time.Duration
+	// When set, every forwarded record gets this TTL instead of the
+	// upstream one
+	overrideTTL *uint32
+	// Per-name TTLs for forwarded records, they win over `overrideTTL`
+	ttlOverrides map[string]uint32
+	// Additional attempts on the same upstream when it times out
+	retries int
+	// nil unless metrics are served
+	metrics *metrics
+	// Questions being resolved upstream
+	inflight flightGroup
+	// Send all the questions of a query in a single upstream query
+	batchQuestions bool
+}
+
+const (
+	defaultUpstreamTimeout = 5 * time.Second
+	defaultUpstreamRetries = 2
+	// Doubled after every attempt
+	retryBackoff = 100 * time.Millisecond
+	// Overall deadline to resolve a single question
+	defaultResolveBudget = 10 * time.Second
+)
 
-		labels, err := decodeLabels(frame, &head, &cache)
+// Every attempt dials its own socket. Concurrent queries never read each
+// other's replies, and each query goes out from a new random source port,
+// see RFC-5452 - 9.2.
+type upstream struct {
+	// udp, tcp, tls or https
+	protocol string
+	// host:port, or host and path for https
+	address   string
+	transport transport
+}
+
+// How a query reaches an upstream, one implementation per protocol.
+// Retries, failover and metrics are up to the forwarder, a transport makes
+// a single attempt that ends by `deadline`. Responses are read with a buffer
+// of `bufSize` bytes where the protocol needs one, `stats` counts the
+// responses that fail to parse.
+type transport interface {
+	attempt(ctx context.Context, query *message, deadline time.Time, bufSize uint16, stats *metrics) (*message, error)
+}
 
+func newUpstream(spec *resolverSpec) (*upstream, error) {
+	u := &upstream{
+		protocol: spec.protocol,
+		address:  spec.address,
+	}
+
+	switch spec.protocol {
+	case "tcp":
+		u.transport = &tcpTransport{address: spec.address}
+	case "tls":
+		u.transport = &tlsTransport{address: spec.address, config: newTLSConfig(spec.serverName)}
+	case "https":
+		u.transport = &httpsTransport{address: spec.address, client: newDoHClient()}
+	default:
+		uaddr, err := net.ResolveUDPAddr("udp", spec.address)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("Failed to resolve UDP address: err = %w", err)
 		}
 
-		question.QNAME = labels
-		question.QTYPE, _ = extractUint16(frame, &head)
-		question.QCLASS, _ = extractUint16(frame, &head)
-		questions = append(questions, question)
+		u.transport = &udpTransport{addr: uaddr, idMismatches: newIDMismatchCounter(uaddr)}
 	}
 
-	// ANSWER
-	answers := make([]*answer, 0, header.ANCOUNT())
+	return u, nil
+}
 
-	for i := uint16(0); i < header.ANCOUNT(); i++ {
-		answer := new(answer)
+func (u *upstream) String() string {
+	if u.protocol == "udp" {
+		return u.address
+	}
 
-		labels, err := decodeLabels(frame, &head, &cache)
+	return u.protocol + "://" + u.address
+}
 
-		if err != nil {
-			return nil, err
+// What we learned from the upstream resolver for a set of questions
+type forwardResult struct {
+	answers []*answer
+	// RFC-2308 - 2.2 - The SOA of NODATA responses, so clients can cache
+	// the absence of data
+	authority []*RR
+	// RFC-4035 - 3.2.3 - Only set when every upstream response was
+	// authenticated
+	authenticData uint8
+	// The first non zero RCODE the upstream answered with, NXDOMAIN for
+	// instance. There is only one RCODE per message.
+	rcode uint8
+}
+
+// Returned for the questions of a query with RD=0 we have no cached answer
+// for
+var errNotCached = errors.New("Not in the cache, recursion not desired")
+
+// `checkingDisabled` is the CD bit of the client query, the upstream resolver
+// must not validate on behalf of a client that wants to do it itself.
+// `recursionDesired` is its RD bit, without it only the cache answers.
+// A question that fails does not stop the others, the result holds whatever
+// could be resolved along with the errors.
+func (f *forwarder) forwardResolve(ctx context.Context, questions []*question, checkingDisabled uint8, recursionDesired uint8) (*forwardResult, error) {
+	// The motivation behind forwarding each question in its own query is
+	// unclear to me, but it is what the test suite from codecrafters expects
+	// and therefore it's what I'll do, unless asked to batch them
+	if f.batchQuestions && len(questions) > 1 && recursionDesired == 1 {
+		result, err := f.resolveBatch(ctx, questions, checkingDisabled)
+		if err == nil {
+			return result, nil
 		}
 
-		var rdLength uint16
+		trace(ctx, "Batched query failed, asking each question on its own", "err", err)
+	}
+
+	result := forwardResult{
+		answers:       make([]*answer, 0, len(questions)),
+		authenticData: 1,
+	}
 
-		answer.NAME = labels
-		answer.TYPE, _ = extractUint16(frame, &head)
-		answer.CLASS, _ = extractUint16(frame, &head)
-		answer.TTL, _ = extractUint32(frame, &head)
-		answer.RDLENGTH, rdLength = extractUint16(frame, &head)
-		answer.RDATA = extractBytes(frame, &head, int(rdLength))
+	// Each question is resolved in its own goroutine, the results are
+	// gathered in the order of the questions
+	responses := make([]*forwardResult, len(questions))
+	errs := make([]error, len(questions))
 
-		answers = append(answers, answer)
+	var wg sync.WaitGroup
+
+	for i, q := range questions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i], errs[i] = f.resolveQuestion(ctx, q, checkingDisabled, recursionDesired)
+		}()
 	}
 
-	message := message{
-		cache:    &cache,
-		header:   header,
-		question: questions,
-		answer:   answers,
+	wg.Wait()
+
+	for i, response := range responses {
+		if errs[i] != nil {
+			result.authenticData = 0
+			continue
+		}
+
+		result.answers = append(result.answers, response.answers...)
+		result.authority = append(result.authority, response.authority...)
+		result.authenticData &= response.authenticData
+
+		if result.rcode == dnsmsg.NOERROR {
+			result.rcode = response.rcode
+		}
+	}
+
+	if len(questions) == 0 {
+		result.authenticData = 0
 	}
 
-	return &message, nil
+	return &result, errors.Join(errs...)
 }
 
-func createResponseMessage(initialMessage *message) *message {
-	header := new(header)
+func (f *forwarder) resolveQuestion(ctx context.Context, q *question, checkingDisabled uint8, recursionDesired uint8) (*forwardResult, error) {
+	// Responses to CD queries did not go through validation, they
+	// must not be served to other clients
+	if f.cache != nil && checkingDisabled == 0 {
+		if hit, ok := f.cache.lookup(ctx, q); ok {
+			return &forwardResult{
+				answers:       hit.answers,
+				authority:     hit.authority,
+				authenticData: hit.authenticData,
+				rcode:         hit.rcode,
+			}, nil
+		}
+	}
 
-	questions := make([]*question, 0, initialMessage.header.QDCOUNT())
-	answers := make([]*answer, 0, initialMessage.header.QDCOUNT())
+	// RFC-1035 - 4.1.1 - RD asks us to pursue the query recursively, a
+	// client that leaves it unset only gets what we already know
+	if recursionDesired == 0 {
+		return nil, errNotCached
+	}
+
+	key := flightKey{cacheKey: newCacheKey(q), checkingDisabled: checkingDisabled}
+
+	resolverResponse, shared, err := f.inflight.do(ctx, key, func() (*message, error) {
+		resolverResponse, err := f.exchange(ctx, []*question{q}, checkingDisabled)
+		if err == nil {
+			f.overrideTTLs(resolverResponse)
+		}
+		if err == nil && f.cache != nil && checkingDisabled == 0 {
+			f.cache.store(q, resolverResponse)
+		}
+		return resolverResponse, err
+	})
+	if err != nil {
+		trace(ctx, "Failed to resolve question", "name", joinLabels(q.QNAME), "shared", shared, "err", err)
+		return nil, err
+	}
 
-	copy(header.bytes[:], initialMessage.header.bytes[:])
+	trace(ctx, "Received upstream response", "name", joinLabels(q.QNAME), "shared", shared, "rcode", resolverResponse.header.RCODE(), "aa", resolverResponse.header.AA(), "answers", rrStrings(resolverResponse.answer), "authority", rrStrings(resolverResponse.authority))
 
-	header.setQR(1)
-	header.setAA(0)
-	header.setTC(0)
-	header.setRA(0)
-	header.setZ(0)
+	// Other callers may hold the same response, the records get their TTL
+	// overridden on their way out
+	received := time.Now()
 
-	if initialMessage.header.OPCODE() == QUERY {
-		header.setRCODE(QUERY)
-	} else {
-		header.setRCODE(UNIMPLEMENTED)
+	result := forwardResult{
+		answers:       copyRRs(resolverResponse.answer, received),
+		authenticData: resolverResponse.header.AD(),
+		rcode:         resolverResponse.header.RCODE(),
 	}
 
-	for i := uint16(0); i < initialMessage.header.QDCOUNT(); i++ {
-		question := new(question)
+	if len(resolverResponse.answer) == 0 {
+		result.authority = copyRRs(resolverResponse.authority, received)
+	}
 
-		question.QNAME = initialMessage.question[i].QNAME
-		question.setType(A)
-		question.setClass(IN)
+	return &result, nil
+}
 
-		questions = append(questions, question)
+// Applied before caching, the cache entry lives as long as the TTL the
+// client is told
+func (f *forwarder) overrideTTLs(response *message) {
+	for _, a := range response.answer {
+		if ttl, ok := f.ttlOverrides[strings.ToLower(joinLabels(a.NAME))]; ok {
+			a.SetTTL(ttl)
+		} else if f.overrideTTL != nil {
+			a.SetTTL(*f.overrideTTL)
+		}
+	}
+}
+
+// All the questions in a single upstream query. Most resolvers only answer
+// the first question, or refuse the query: the response must echo every
+// question for us to use it.
+// The response cannot be split per question, it is not cached.
+func (f *forwarder) resolveBatch(ctx context.Context, questions []*question, checkingDisabled uint8) (*forwardResult, error) {
+	resolverResponse, err := f.exchange(ctx, questions, checkingDisabled)
+	if err != nil {
+		return nil, err
 	}
 
-	header.setQDCOUNT(uint16(len(questions)))
+	f.overrideTTLs(resolverResponse)
 
-	response := message{
-		header:   header,
-		question: questions,
-		answer:   answers,
+	if len(resolverResponse.question) != len(questions) {
+		return nil, fmt.Errorf("Resolver answered %d of the %d questions", len(resolverResponse.question), len(questions))
 	}
 
-	return &response
+	trace(ctx, "Received batched upstream response", "questions", questionNames(questions), "rcode", resolverResponse.header.RCODE(), "answers", rrStrings(resolverResponse.answer), "authority", rrStrings(resolverResponse.authority))
+
+	result := forwardResult{
+		answers:       resolverResponse.answer,
+		authenticData: resolverResponse.header.AD(),
+		rcode:         resolverResponse.header.RCODE(),
+	}
+
+	if len(resolverResponse.answer) == 0 {
+		result.authority = resolverResponse.authority
+	}
+
+	return &result, nil
 }
 
-func forwardResolve(questions []*question, conn *net.UDPConn) ([]*answer, error) {
-	// The motivation behind forwarding each question in its own query is
-	// unclear to me, but it is what the test suite from codecrafters expects
-	// and therefore it's what I'll do
+// Sends the questions to each resolver in turn, until one of them
+// answers with something else than SERVFAIL
+func (f *forwarder) exchange(ctx context.Context, questions []*question, checkingDisabled uint8) (*message, error) {
+	// Retries and failover included, a question does not hold the client
+	// longer than this
+	ctx, cancel := context.WithTimeout(ctx, f.budget)
+	defer cancel()
 
-	answers := make([]*answer, 0, len(questions))
+	deadline, _ := ctx.Deadline()
 
-	for _, q := range questions {
-		message := message{
-			header:   new(header),
-			question: []*question{q},
-			answer:   nil,
-		}
-
-		message.header.setId(uint16(rand.IntN(math.MaxUint16)))
-		message.header.setQR(0)
-		message.header.setAA(0)
-		message.header.setTC(0)
-		message.header.setRA(0)
-		message.header.setRD(1)
-		message.header.setZ(0)
-		message.header.setQDCOUNT(1)
-
-		serialized, err := message.serialize()
-		if err != nil {
-			return answers, err
+	errs := make([]error, 0, len(f.upstreams))
+
+	for i, u := range f.upstreams {
+		// Every upstream gets an equal share of what is left, retries
+		// against a dead one never leave the next ones without a turn
+		share := time.Until(deadline) / time.Duration(len(f.upstreams)-i)
+		upstreamCtx, cancelUpstream := context.WithTimeout(ctx, share)
+
+		start := time.Now()
+		resolverResponse, err := f.exchangeWith(upstreamCtx, u, questions, checkingDisabled)
+		latency := time.Since(start)
+		cancelUpstream()
+		f.metrics.upstreamExchange(u.String(), latency, err)
+
+		if err == nil && resolverResponse.header.RCODE() == dnsmsg.SERVFAIL {
+			err = fmt.Errorf("Resolver answered SERVFAIL")
 		}
 
-		_, err = conn.Write(serialized)
 		if err != nil {
-			return answers, fmt.Errorf("Failed to send query to resolver")
+			trace(ctx, "Upstream failed", "questions", questionNames(questions), "upstream", u, "err", err)
+			slog.DebugContext(ctx, "Upstream failed", "questions", questionNames(questions), "types", questionTypes(questions), "upstream", u, "latency", latency, "err", err)
+			errs = append(errs, fmt.Errorf("Error querying resolver %s: err = %w", u, err))
+			continue
 		}
 
-		buf := make([]byte, 512)
-		size, _, err := conn.ReadFromUDP(buf)
-		if err != nil {
-			return answers, fmt.Errorf("Failed to read response from resolver")
+		slog.DebugContext(ctx, "Upstream answered", "questions", questionNames(questions), "types", questionTypes(questions), "upstream", u, "latency", latency, "rcode", resolverResponse.header.RCODE())
+
+		return resolverResponse, nil
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// Retries on timeout only, waiting twice as long before each new attempt.
+// Every attempt has its own ID and socket.
+func (f *forwarder) exchangeWith(ctx context.Context, u *upstream, questions []*question, checkingDisabled uint8) (*message, error) {
+	backoff := retryBackoff
+
+	for attempt := 0; ; attempt++ {
+		resolverResponse, err := f.attempt(ctx, u, questions, checkingDisabled)
+		if err == nil || !errors.Is(err, os.ErrDeadlineExceeded) || attempt == f.retries {
+			return resolverResponse, err
 		}
 
-		incomingFrame := buf[:size]
-		resolverResponse, err := deserialize(incomingFrame)
-		if err != nil {
-			return answers, fmt.Errorf("Failed to parse response from resolver")
+		trace(ctx, "Retrying upstream", "questions", questionNames(questions), "upstream", u, "attempt", attempt+2, "backoff", backoff)
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("Gave up after %d attempts: err = %w", attempt+1, ctx.Err())
+		case <-time.After(backoff):
 		}
 
-		answers = append(answers, resolverResponse.answer...)
+		backoff *= 2
 	}
+}
+
+func (f *forwarder) attempt(ctx context.Context, u *upstream, questions []*question, checkingDisabled uint8) (*message, error) {
+	query := f.newUpstreamQuery(questions, checkingDisabled)
 
-	return answers, nil
+	return u.transport.attempt(ctx, query, f.attemptDeadline(ctx, time.Now()), f.ednsBufSize, f.metrics)
 }
 
-func (m *message) addStaticAnswer() error {
-	// This server is a toy project.
-	// It does not actually store any records.
-	// When it is *not* in forwarder mode it answers every request with the
-	// same IP address and same TTL.
-	ip, err := netip.ParseAddr("8.8.8.8")
-	if err != nil {
-		return fmt.Errorf("Failed to parse IP address")
+// A fresh ID for every attempt
+func (f *forwarder) newUpstreamQuery(questions []*question, checkingDisabled uint8) *message {
+	message := message{
+		header:     new(header),
+		question:   questions,
+		answer:     nil,
+		additional: []*RR{newOPT(f.ednsBufSize)},
 	}
 
-	for i := uint16(0); i < m.header.QDCOUNT(); i++ {
-		answer := new(answer)
-
-		answer.NAME = m.question[i].QNAME
-		answer.setType(A)
-		answer.setClass(IN)
-		answer.setTTL(60)
-		answer.setData(ip.AsSlice())
+	message.header.SetID(random.uint16())
+	message.header.SetQR(0)
+	message.header.SetOPCODE(dnsmsg.QUERY)
+	message.header.SetAA(0)
+	message.header.SetTC(0)
+	message.header.SetRA(0)
+	message.header.SetRD(1)
+	message.header.SetZ(0)
+	message.header.SetCD(checkingDisabled)
+	message.header.SetQDCOUNT(uint16(len(questions)))
+	message.header.SetARCOUNT(1)
+
+	return &message
+}
 
-		m.answer = append(m.answer, answer)
+// An attempt lasts the upstream timeout, or less when the question is about
+// to run out of time. Mismatched replies do not extend it.
+func (f *forwarder) attemptDeadline(ctx context.Context, sent time.Time) time.Time {
+	deadline := sent.Add(f.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
 	}
 
-	m.header.setANCOUNT(uint16(len(m.answer)))
+	return deadline
+}
 
-	return nil
+type udpTransport struct {
+	addr *net.UDPAddr
+	// Replies discarded because of their ID
+	idMismatches *idMismatchCounter
 }
 
-func (m *message) serialize() ([]byte, error) {
-	totalLen := len(m.header.bytes) + m.questionLen() + m.answerLen()
+func (t *udpTransport) attempt(ctx context.Context, query *message, deadline time.Time, bufSize uint16, stats *metrics) (*message, error) {
+	conn, err := net.DialUDP("udp", nil, t.addr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to resolver: err = %w", err)
+	}
+	defer conn.Close()
 
-	buf := make([]byte, 0, totalLen)
+	serialized, err := query.serialize()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(serialized)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to send query to resolver")
+	}
 
-	buf = append(buf, m.header.bytes[:]...)
+	trace(ctx, "Forwarded question", "questions", query.questionNames(), "upstream", t.addr, "id", query.header.ID())
 
-	for _, q := range m.question {
-		encodedLabelSequence, err := encodeLabelSequence(q.QNAME)
+	sent := time.Now()
+	conn.SetReadDeadline(deadline)
+
+	buf := make([]byte, bufSize)
+
+	for {
+		size, _, err := conn.ReadFromUDP(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, fmt.Errorf("Resolver did not answer within %s: err = %w", time.Since(sent).Round(time.Millisecond), err)
+		}
 		if err != nil {
-			return buf, err
+			return nil, fmt.Errorf("Failed to read response from resolver: err = %w", err)
 		}
 
-		buf = append(buf, encodedLabelSequence...)
-		buf = append(buf, q.QTYPE[:]...)
-		buf = append(buf, q.QCLASS[:]...)
-	}
-
-	for _, a := range m.answer {
-		encodedLabelSequence, err := encodeLabelSequence(a.NAME)
+		incomingFrame := buf[:size]
+		// Anyone who knows our port can send garbage, it must not fail the
+		// query the real reply may still be on its way for
+		resolverResponse, err := deserialize(incomingFrame)
 		if err != nil {
-			return buf, err
+			trace(ctx, "Discarded upstream frame that failed to parse", "err", err)
+			stats.upstreamParseFailure()
+			continue
+		}
+
+		// A query, possibly our own reflected back, is not an answer
+		if resolverResponse.header.QR() != 1 {
+			trace(ctx, "Discarded upstream frame that is not a response", "id", resolverResponse.header.ID())
+			continue
+		}
+
+		// Accepting a reply to another query would let anyone who can
+		// guess our port poison the answer
+		if resolverResponse.header.ID() != query.header.ID() {
+			trace(ctx, "Discarded upstream reply with mismatched ID", "expected", query.header.ID(), "got", resolverResponse.header.ID())
+			t.idMismatches.record()
+			continue
 		}
 
-		buf = append(buf, encodedLabelSequence...)
-		buf = append(buf, a.TYPE[:]...)
-		buf = append(buf, a.CLASS[:]...)
-		buf = append(buf, a.TTL[:]...)
-		buf = append(buf, a.RDLENGTH[:]...)
-		buf = append(buf, a.RDATA...)
+		return resolverResponse, nil
 	}
+}
 
-	return buf, nil
+// The answer given when there is no resolver or zone: the same address
+// and TTL for every A or AAAA question, or those of the name in the hosts
+// file when one is loaded.
+type staticAnswer struct {
+	ipv4 netip.Addr
+	ipv6 netip.Addr
+	ttl  uint32
+	// Per name answers replacing the one above, when set
+	hosts hostsTable
 }
 
-func (m *message) questionLen() int {
-	total := 0
+var defaultStaticAnswer = staticAnswer{
+	ipv4: netip.MustParseAddr("8.8.8.8"),
+	ipv6: netip.MustParseAddr("2001:4860:4860::8888"),
+	ttl:  60,
+}
 
-	for _, q := range m.question {
-		total += q.len()
+// The QTYPEs the static answer has an address for.
+// Other known types get an empty NOERROR, unknown ones NOTIMP.
+var staticAnswerTypes = map[uint16]func(*staticAnswer) netip.Addr{
+	dnsmsg.A:    func(static *staticAnswer) netip.Addr { return static.ipv4 },
+	dnsmsg.AAAA: func(static *staticAnswer) netip.Addr { return static.ipv6 },
+}
+
+// As with NXDOMAIN, a single unsupported question makes the whole response
+// NOTIMP, there is only one RCODE per message.
+func (m *message) addStaticAnswer(questions []*question, static *staticAnswer) error {
+	for _, q := range questions {
+		if q.Class() != dnsmsg.IN {
+			m.header.SetRCODE(dnsmsg.NOTIMP)
+			continue
+		}
+
+		answer := static
+		if static.hosts != nil {
+			entry, ok := static.hosts.lookup(q.QNAME)
+			if !ok {
+				m.header.SetRCODE(dnsmsg.NXDOMAIN)
+				continue
+			}
+			answer = entry
+		}
+
+		address, ok := staticAnswerTypes[q.Type()]
+		if ok {
+			// A name of the hosts file may lack an address of that family
+			if ip := address(answer); ip.IsValid() {
+				m.addAnswer(q, ip, answer.ttl)
+			}
+		} else if !dnsmsg.KnownRRType(q.Type()) {
+			m.header.SetRCODE(dnsmsg.NOTIMP)
+		}
 	}
 
-	return total
+	return nil
 }
 
-func (m *message) answerLen() int {
-	total := 0
+// A or AAAA depending on the address
+func (m *message) addAnswer(q *question, ip netip.Addr, ttl uint32) {
+	answer := new(answer)
 
-	for _, a := range m.answer {
-		total += a.len()
+	answer.NAME = q.QNAME
+	answer.SetType(dnsmsg.A)
+	if ip.Is6() {
+		answer.SetType(dnsmsg.AAAA)
 	}
+	answer.SetClass(dnsmsg.IN)
+	answer.SetTTL(ttl)
+	answer.SetData(ip.AsSlice())
 
-	return total
+	m.answer = append(m.answer, answer)
+	m.header.SetANCOUNT(uint16(len(m.answer)))
 }
 
-// RFC 1035 - 4.1.1 - Header section format
-type header struct {
-	bytes [12]byte
+// The wire format of the message, sharing its sections
+func (m *message) wire() *dnsmsg.Message {
+	return &dnsmsg.Message{
+		Header:     m.header,
+		Question:   m.question,
+		Answer:     m.answer,
+		Authority:  m.authority,
+		Additional: m.additional,
+	}
 }
 
-func (h *header) setId(id uint16) {
-	binary.BigEndian.PutUint16(h.bytes[0:2], id)
+// Names are written in full, see `serializeCompressed`
+func (m *message) serialize() ([]byte, error) {
+	return dnsmsg.Marshal(m.wire())
 }
 
-func (h *header) id() uint16 {
-	return binary.BigEndian.Uint16(h.bytes[0:2])
-}
+// The RDATA of records holding a single name: CNAME, NS & PTR.
+// The RDATA of records decoded from a frame is never compressed.
+func nameRDATA(rr *RR, rrtype uint16) ([]string, bool) {
+	if rr.Type() != rrtype {
+		return nil, false
+	}
 
-func (h *header) setQR(isReply uint8) {
-	h.bytes[2] = h.bytes[2] | isReply<<7
-}
+	labels, end, ok := rdataLabels(rr.RDATA, 0)
+	if !ok || end != len(rr.RDATA) {
+		return nil, false
+	}
 
-func (h *header) OPCODE() uint8 {
-	return (h.bytes[2] & 0b01111000) >> 3
+	return labels, true
 }
 
-func (h *header) setAA(isAuthoritativeAnswer uint8) {
-	h.bytes[2] = h.bytes[2] | isAuthoritativeAnswer<<2
-}
+func setNameRDATA(rr *RR, rrtype uint16, name []string) error {
+	data, err := dnsmsg.EncodeName(name)
+	if err != nil {
+		return err
+	}
 
-func (h *header) setTC(isTruncated uint8) {
-	h.bytes[2] = h.bytes[2] | isTruncated<<1
-}
+	rr.SetType(rrtype)
+	rr.SetData(data)
 
-func (h *header) setRD(recursionDesired uint8) {
-	h.bytes[2] = h.bytes[2] | recursionDesired
+	return nil
 }
 
-func (h *header) RD() uint8 {
-	return h.bytes[2] & 0b00000001
+// RFC-1035 - 3.3.1 - The canonical name of a CNAME record
+func rdataCNAME(rr *RR) ([]string, bool) {
+	return nameRDATA(rr, dnsmsg.CNAME)
 }
 
-func (h *header) setRA(recursionAvailable uint8) {
-	h.bytes[3] = h.bytes[3] | recursionAvailable<<7
+func setCNAME(rr *RR, target []string) error {
+	return setNameRDATA(rr, dnsmsg.CNAME, target)
 }
 
-func (h *header) setZ(val uint8) {
-	h.bytes[3] = (h.bytes[3] & 0b10001111) | (val & 0b01110000)
+// RFC-1035 - 3.3.11 - The NSDNAME of an NS record
+func rdataNS(rr *RR) ([]string, bool) {
+	return nameRDATA(rr, dnsmsg.NS)
 }
 
-func (h *header) setRCODE(code uint8) {
-	h.bytes[3] = (h.bytes[3] & 0b11110000) | (code & 0b00001111)
+// RFC-1035 - 3.3.12 - The PTRDNAME of a PTR record, the name of a reverse
+// lookup under `in-addr.arpa` or `ip6.arpa`
+func rdataPTR(rr *RR) ([]string, bool) {
+	return nameRDATA(rr, dnsmsg.PTR)
 }
 
-func (h *header) setQDCOUNT(count uint16) {
-	binary.BigEndian.PutUint16(h.bytes[4:6], count)
+func setPTR(rr *RR, target []string) error {
+	return setNameRDATA(rr, dnsmsg.PTR, target)
 }
 
-func (h *header) QDCOUNT() uint16 {
-	return binary.BigEndian.Uint16(h.bytes[4:6])
-}
+// The PREFERENCE and EXCHANGE of an MX record
+func rdataMX(rr *RR) (uint16, []string, bool) {
+	if rr.Type() != dnsmsg.MX || len(rr.RDATA) < 3 {
+		return 0, nil, false
+	}
 
-func (h *header) setANCOUNT(count uint16) {
-	binary.BigEndian.PutUint16(h.bytes[6:8], count)
-}
+	labels, end, ok := rdataLabels(rr.RDATA, 2)
+	if !ok || end != len(rr.RDATA) {
+		return 0, nil, false
+	}
 
-func (h *header) ANCOUNT() uint16 {
-	return binary.BigEndian.Uint16(h.bytes[6:8])
+	return binary.BigEndian.Uint16(rr.RDATA[:2]), labels, true
 }
 
-// RFC 1035 - 4.1.2 - Question section format
-type question struct {
-	QNAME  []string
-	QTYPE  [2]byte
-	QCLASS [2]byte
-}
+func setMX(rr *RR, preference uint16, exchange []string) error {
+	data, err := dnsmsg.EncodeName(exchange)
+	if err != nil {
+		return err
+	}
 
-func (q *question) len() int {
-	return len(q.QNAME) + 4
-}
+	rr.SetType(dnsmsg.MX)
+	rr.SetData(append(binary.BigEndian.AppendUint16(nil, preference), data...))
 
-func (q *question) setType(t uint16) {
-	binary.BigEndian.PutUint16(q.QTYPE[:], t)
+	return nil
 }
 
-func (q *question) setClass(c uint16) {
-	binary.BigEndian.PutUint16(q.QCLASS[:], c)
-}
+// RFC-1035 - 3.3.14 - TXT RDATA format
+// One or more <character-string>, each prefixed by its length on one byte
+func rdataTXT(rr *RR) ([]string, bool) {
+	if rr.Type() != dnsmsg.TXT || len(rr.RDATA) == 0 {
+		return nil, false
+	}
 
-// RFC 1035 - 4.1.3 - RR format
-type RR struct {
-	NAME     []string
-	TYPE     [2]byte
-	CLASS    [2]byte
-	TTL      [4]byte
-	RDLENGTH [2]byte
-	RDATA    []byte
-}
+	strs := make([]string, 0)
 
-type answer = RR
+	for head := 0; head < len(rr.RDATA); {
+		length := int(rr.RDATA[head])
+		head++
 
-func (rr *RR) len() int {
-	return len(rr.NAME) + 10 + len(rr.RDATA)
+		if head+length > len(rr.RDATA) {
+			return nil, false
+		}
+
+		strs = append(strs, string(rr.RDATA[head:head+length]))
+		head += length
+	}
+
+	return strs, true
 }
 
-func (rr *RR) setType(t uint16) {
-	binary.BigEndian.PutUint16(rr.TYPE[:], t)
+// RFC-1035 - 3.3 - A <character-string> is at most 255 bytes
+const maxCharacterString = 255
+
+// Strings longer than a <character-string> are split over several of them,
+// as is done for long SPF or DKIM records, see RFC-7208 - 3.3
+func setTXT(rr *RR, strs []string) error {
+	data := make([]byte, 0)
+
+	for _, str := range strs {
+		for {
+			chunk := str[:min(len(str), maxCharacterString)]
+			data = append(data, byte(len(chunk)))
+			data = append(data, chunk...)
+
+			str = str[len(chunk):]
+			if len(str) == 0 {
+				break
+			}
+		}
+	}
+
+	if len(data) == 0 {
+		return fmt.Errorf("A TXT record needs at least one string")
+	}
+
+	if len(data) > 0xFFFF {
+		return fmt.Errorf("RDATA too long: %d bytes", len(data))
+	}
+
+	rr.SetType(dnsmsg.TXT)
+	rr.SetData(data)
+
+	return nil
 }
 
-func (rr *RR) setClass(c uint16) {
-	binary.BigEndian.PutUint16(rr.CLASS[:], c)
+// The TTL left for a record stored at `storedAt`, never below 0
+func remainingTTL(rr *RR, storedAt time.Time) uint32 {
+	elapsed := time.Since(storedAt) / time.Second
+
+	if elapsed >= time.Duration(rr.TTLSeconds()) {
+		return 0
+	}
+
+	return rr.TTLSeconds() - uint32(elapsed)
 }
 
-func (rr *RR) setTTL(ttl uint32) {
-	binary.BigEndian.PutUint32(rr.TTL[:], ttl)
+// How to reach a resolver, `--resolver` entries look like
+// `udp://8.8.8.8`, `tls://1.1.1.1` or `https://dns.google/dns-query`.
+// Entries without a scheme are UDP.
+type resolverSpec struct {
+	protocol string
+	address  string
+	// The name the certificate of a TLS resolver is checked against
+	serverName string
 }
 
-func (rr *RR) setData(data []byte) {
-	binary.BigEndian.PutUint16(rr.RDLENGTH[:], uint16(len(data)))
-	rr.RDATA = data
+func parseResolver(entry string) (*resolverSpec, error) {
+	protocol, address, found := strings.Cut(entry, "://")
+	if !found {
+		protocol = "udp"
+		address = entry
+	}
+
+	switch protocol {
+	case "udp", "tcp":
+		addr, err := parseResolverAddress(address, "53")
+		if err != nil {
+			return nil, err
+		}
+
+		return &resolverSpec{protocol: protocol, address: addr}, nil
+	case "tls":
+		address, serverName, _ := strings.Cut(address, "#")
+
+		addr, err := parseResolverAddress(address, defaultTLSPort)
+		if err != nil {
+			return nil, err
+		}
+
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(addr)
+		}
+
+		return &resolverSpec{protocol: protocol, address: addr, serverName: serverName}, nil
+	case "https":
+		addr, err := parseDoHAddress(address)
+		if err != nil {
+			return nil, err
+		}
+
+		return &resolverSpec{protocol: protocol, address: addr}, nil
+	default:
+		return nil, fmt.Errorf("unknown resolver protocol: %s", protocol)
+	}
 }
 
-func parseResolverAddress(addr string) (string, error) {
+// A missing port is `defaultPort`
+func parseResolverAddress(addr string, defaultPort string) (string, error) {
 	ip, port, err := net.SplitHostPort(addr)
 
 	if err != nil {
-		if addrErr, ok := err.(*net.AddrError); ok && addrErr.Err == "missing port in address" {
+		// A bare IPv6 address has too many colons to be split
+		if net.ParseIP(addr) != nil {
 			ip = addr
-			port = "53"
+			port = defaultPort
+		} else if addrErr, ok := err.(*net.AddrError); ok && addrErr.Err == "missing port in address" {
+			// `[2001:db8::1]` without a port
+			ip = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+			port = defaultPort
 		}
-
 	}
 
-	parsedIp := net.ParseIP(ip)
-
-	if parsedIp.To4() == nil || parsedIp.To16() == nil {
+	// Both IPv4 and IPv6 addresses have a 16 bytes form
+	if net.ParseIP(ip).To16() == nil {
 		return "", fmt.Errorf("invalid IP address: %s", ip)
 	}
 
@@ -548,97 +945,450 @@ func parseResolverAddress(addr string) (string, error) {
 		return "", fmt.Errorf("invalid port number: %s", port)
 	}
 
-	return fmt.Sprintf("%s:%s", ip, port), nil
+	// IPv6 addresses are bracketed, `[2001:db8::1]:53`
+	return net.JoinHostPort(ip, port), nil
 }
 
-func main() {
-	errorLogger := log.New(os.Stderr, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
+// Where the UDP and TCP listeners are bound unless `--listen` is given
+const defaultListenAddress = "127.0.0.1:2053"
 
-	var resolverConn *net.UDPConn
+// Same rules as the resolver address, a missing port is the DNS port
+func parseListenAddress(addr string) (string, error) {
+	return parseResolverAddress(addr, "53")
+}
 
-	if len(os.Args) == 3 && os.Args[1] == "--resolver" {
-		addr, err := parseResolverAddress(os.Args[2])
+func main() {
+	ednsBufSize := defaultEDNSBufSize
+	var resolverArgs []string
+	listenAddress := defaultListenAddress
+	specialUse := defaultSpecialUseTable()
+	traced := make(traceNames)
+	var overrideTTL *uint32
+	queryLog := false
+	var cacheSize int
+	var upstreamTimeout time.Duration
+	var upstreamRetries int
+	logCacheMisses := false
+	var hints *rootHints
+	serveRootHints := false
+	clientWindow := time.Minute
+	var clientThreshold uint64
+	probeOnStart := false
+	probeFatal := false
+	var unixPath string
+	maxQuerySize := defaultMaxQuerySize
+	udpWorkers := defaultUDPWorkers
+	var buffers socketBuffers
+	var dnr [][]byte
+	failClosed := false
+	ttlOverrides := make(map[string]uint32)
+	noUDP := false
+	var hostsFile string
+	logLevel := slog.LevelInfo
+	var zoneFile string
+	var anyLabel bool
+	var metricsAddr string
+	batchQuestions := false
+	var dohAddr, dohCert, dohKey string
+	noTCP := false
+	noCompression := false
+	static := defaultStaticAnswer
+
+	flag.Func("resolver", "Forward queries to `address`, udp://host:port, tcp://host:port, tls://host:port#name, https://host/path or host:port. Repeat it or separate with commas for failover", func(value string) error {
+		for _, resolverArg := range strings.Split(value, ",") {
+			resolverArgs = append(resolverArgs, strings.TrimSpace(resolverArg))
+		}
+		return nil
+	})
+	flag.BoolVar(&batchQuestions, "batch-questions", false, "Send all the questions of a query in one upstream query, one per question when the resolver does not answer them all")
+	flag.Func("resolver-doh", "Forward queries over HTTPS to `url`, e.g. https://dns.google/dns-query. Same as an https:// resolver", func(value string) error {
+		if !strings.HasPrefix(value, "https://") {
+			return fmt.Errorf("not an https:// URL")
+		}
+		resolverArgs = append(resolverArgs, value)
+		return nil
+	})
+	flag.Func("resolver-tls", "Forward queries over TLS to `host:port#name`, the certificate is checked against name, or host without it. Same as a tls:// resolver", func(value string) error {
+		for _, resolverArg := range strings.Split(value, ",") {
+			resolverArgs = append(resolverArgs, "tls://"+strings.TrimSpace(resolverArg))
+		}
+		return nil
+	})
+	flag.Func("listen", "Bind the UDP and TCP listeners to `host:port` (default "+defaultListenAddress+")", func(value string) error {
+		address, err := parseListenAddress(value)
 		if err != nil {
-			fmt.Println("Failed to parse resolver address:", err)
-			return
+			return err
 		}
-
-		uaddr, err := net.ResolveUDPAddr("udp", addr)
+		listenAddress = address
+		return nil
+	})
+	flag.Func("special-use", "Handle a special-use TLD as `tld=forward|nxdomain|loopback|static` (repeatable)", func(value string) error {
+		if specialUse == nil {
+			return nil
+		}
+		return specialUse.set(value)
+	})
+	flag.BoolFunc("no-special-use", "Forward special-use names as any other", func(string) error {
+		specialUse = nil
+		return nil
+	})
+	flag.Func("trace-name", "Trace queries for `name` end-to-end (repeatable)", func(value string) error {
+		traced.add(value)
+		return nil
+	})
+	flag.Func("override-ttl", "Force the TTL of every forwarded record to `seconds`", func(value string) error {
+		ttl, err := strconv.ParseUint(value, 10, 32)
 		if err != nil {
-			fmt.Println("Failed to resolve UDP address:", err)
-			return
+			return err
 		}
-
-		resolverConn, err = net.DialUDP("udp", nil, uaddr)
+		overrideTTL = new(uint32)
+		*overrideTTL = uint32(ttl)
+		return nil
+	})
+	flag.Func("ttl-override", "Force the TTL of the records of a single name, `name=seconds` (repeatable)", func(value string) error {
+		name, ttlValue, found := strings.Cut(value, "=")
+		ttl, err := strconv.ParseUint(ttlValue, 10, 32)
+		if !found || err != nil {
+			return fmt.Errorf("expected name=seconds")
+		}
+		ttlOverrides[strings.ToLower(strings.TrimSuffix(name, "."))] = uint32(ttl)
+		return nil
+	})
+	flag.BoolVar(&queryLog, "query-log", false, "Log one line per query")
+	flag.DurationVar(&upstreamTimeout, "upstream-timeout", defaultUpstreamTimeout, "How long to wait for each resolver before failing over or answering SERVFAIL")
+	flag.IntVar(&upstreamRetries, "upstream-retries", defaultUpstreamRetries, "Attempts on a resolver that timed out, with an exponential backoff, before failing over")
+	flag.IntVar(&cacheSize, "cache-size", 0, "Cache up to this many forwarded answers, 0 disables the cache")
+	flag.BoolVar(&logCacheMisses, "log-cache-misses", false, "Log why each cache lookup missed")
+	flag.BoolVar(&serveRootHints, "serve-root-hints", false, "Answer root NS queries from the embedded root hints")
+	flag.Func("edns-bufsize", "UDP payload `size` advertised upstream, 512-65535 (default 1232)", func(value string) error {
+		size, err := strconv.ParseUint(value, 10, 16)
+		if err != nil || uint16(size) < minEDNSBufSize {
+			return fmt.Errorf("must be within 512-65535")
+		}
+		ednsBufSize = uint16(size)
+		return nil
+	})
+	flag.DurationVar(&clientWindow, "client-window", time.Minute, "Sliding window of the per-client query counters")
+	flag.Uint64Var(&clientThreshold, "client-threshold", 0, "Warn about clients above this many queries per window, 0 disables the warnings")
+	flag.BoolVar(&probeOnStart, "probe-on-start", false, "Resolve a known name through the resolver on startup")
+	flag.BoolVar(&probeFatal, "probe-fatal", false, "Exit when the startup probe fails")
+	flag.StringVar(&unixPath, "unix-listen", "", "Also serve queries on the Unix domain socket at `path`")
+	flag.StringVar(&dohAddr, "doh-listen", "", "Also serve DNS over HTTPS queries on `host:port`, at /dns-query")
+	flag.StringVar(&dohCert, "doh-cert", "", "Certificate `file` of the DoH listener, plain HTTP without it")
+	flag.StringVar(&dohKey, "doh-key", "", "Private key `file` of the DoH listener")
+	flag.BoolVar(&noUDP, "no-udp", false, "Disable the UDP listener")
+	flag.BoolVar(&noTCP, "no-tcp", false, "Disable the TCP listener")
+	flag.Func("max-query-size", "Largest query processed, in `bytes`, 12-65535 (default 512)", func(value string) error {
+		size, err := strconv.ParseUint(value, 10, 16)
+		if err != nil || size < 12 {
+			return fmt.Errorf("must be within 12-65535")
+		}
+		maxQuerySize = int(size)
+		return nil
+	})
+	flag.Func("workers", "Goroutines handling UDP queries, at least 1 (default 64)", func(value string) error {
+		workers, err := strconv.Atoi(value)
+		if err != nil || workers < 1 {
+			return fmt.Errorf("must be at least 1")
+		}
+		udpWorkers = workers
+		return nil
+	})
+	flag.Func("so-rcvbuf", "Kernel receive buffer of the UDP socket, in `bytes`", func(value string) error {
+		size, err := strconv.ParseUint(value, 10, 31)
+		buffers.rcvbuf = int(size)
+		return err
+	})
+	flag.Func("so-sndbuf", "Kernel send buffer of the UDP socket, in `bytes`", func(value string) error {
+		size, err := strconv.ParseUint(value, 10, 31)
+		buffers.sndbuf = int(size)
+		return err
+	})
+	flag.Func("dnr-svcb", "Answer _dns.resolver.arpa SVCB queries with `record`, e.g. \"1 dns.example.net alpn=dot\" (repeatable)", func(value string) error {
+		data, err := encodeSVCB(value)
 		if err != nil {
-			fmt.Println("Failed to connect to resolver:", err)
-			return
+			return err
+		}
+		dnr = append(dnr, data)
+		return nil
+	})
+	flag.BoolVar(&failClosed, "fail-closed", false, "Answer SERVFAIL instead of the static answer without a resolver")
+	flag.BoolVar(&noCompression, "no-compression", false, "Write names in full in responses")
+	flag.Func("static-ip", "IPv4 `address` of the static answer to A questions (default 8.8.8.8)", func(value string) error {
+		ip, err := netip.ParseAddr(value)
+		if err != nil || !ip.Is4() {
+			return fmt.Errorf("not an IPv4 address")
 		}
-		defer resolverConn.Close()
+		static.ipv4 = ip
+		return nil
+	})
+	flag.Func("static-ttl", "TTL in `seconds` of the static answer (default 60)", func(value string) error {
+		ttl, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return err
+		}
+		static.ttl = uint32(ttl)
+		return nil
+	})
+	flag.TextVar(&logLevel, "log-level", logLevel, "Log messages of at least this `level`: debug, info, warn or error")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Serve Prometheus metrics over HTTP on `address`, e.g. 127.0.0.1:9153")
+	flag.StringVar(&hostsFile, "hosts-file", "", "Answer from a hosts `file` instead of the static answer, unknown names are NXDOMAIN")
+	flag.BoolVar(&anyLabel, "any-label", false, "Accept names of any characters in --hosts-file and --zone-file, e.g. _sip._tcp, instead of letters, digits and hyphens only")
+	flag.StringVar(&zoneFile, "zone-file", "", "Answer authoritatively from a zone `file` in master format instead of the static answer")
+	flag.Func("static-ipv6", "IPv6 `address` of the static answer to AAAA questions", func(value string) error {
+		ip, err := netip.ParseAddr(value)
+		if err != nil || !ip.Is6() {
+			return fmt.Errorf("not an IPv6 address")
+		}
+		static.ipv6 = ip
+		return nil
+	})
+
+	flag.Parse()
+
+	slog.SetDefault(slog.New(traceHandler{slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})}))
+
+	// Flags stop at the first non-flag argument
+	if flag.NArg() > 0 {
+		slog.Error("Unknown argument", "arg", flag.Arg(0))
+		os.Exit(2)
 	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:2053")
-	if err != nil {
-		fmt.Println("Failed to resolve UDP address:", err)
-		return
+	if upstreamTimeout <= 0 {
+		slog.Error("Invalid upstream timeout", "timeout", upstreamTimeout)
+		os.Exit(2)
 	}
 
-	udpConn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		fmt.Println("Failed to bind to address:", err)
-		return
+	if upstreamRetries < 0 {
+		slog.Error("Invalid upstream retries", "retries", upstreamRetries)
+		os.Exit(2)
+	}
+
+	if clientWindow <= 0 {
+		slog.Error("Invalid client window", "window", clientWindow)
+		os.Exit(2)
 	}
-	defer udpConn.Close()
 
-	buf := make([]byte, 512)
+	// Both answer in place of a resolver. The hosts file is still used for
+	// the special-use names answered with the static answer.
+	if zoneFile != "" && len(resolverArgs) > 0 {
+		slog.Error("--zone-file answers instead of a resolver, it can't be used with --resolver")
+		os.Exit(2)
+	}
 
-	for {
-		size, source, err := udpConn.ReadFromUDP(buf)
+	if hostsFile != "" && len(resolverArgs) > 0 && !specialUse.answersStatic() {
+		slog.Warn("--hosts-file is only used without a resolver, or for special-use names set to static")
+	}
+
+	if serveRootHints {
+		var err error
+		hints, err = parseRootHints(namedRoot)
 		if err != nil {
-			errorLogger.Println(fmt.Errorf("Error receiving data: err = %w", err))
-			break
+			slog.Error("Failed to parse root hints", "err", err)
+			os.Exit(1)
 		}
+	}
 
-		// Do not mutate the incoming frame
-		incomingFrame := buf[:size]
-		incomingMessage, err := deserialize(incomingFrame)
+	if hostsFile != "" {
+		data, err := os.ReadFile(hostsFile)
 		if err != nil {
-			errorLogger.Println(fmt.Errorf("Error parsing the received frame: err = %w", err))
-			continue
+			slog.Error("Failed to read hosts file", "err", err)
+			os.Exit(1)
 		}
 
-		response := createResponseMessage(incomingMessage)
+		static.hosts, err = parseHosts(string(data), static.ttl, anyLabel)
+		if err != nil {
+			slog.Error("Failed to parse hosts file", "path", hostsFile, "err", err)
+			os.Exit(1)
+		}
+	}
 
-		if resolverConn != nil {
-			answers, err := forwardResolve(response.question, resolverConn)
+	var records *zone
+	if zoneFile != "" {
+		data, err := os.ReadFile(zoneFile)
+		if err != nil {
+			slog.Error("Failed to read zone file", "err", err)
+			os.Exit(1)
+		}
 
-			if err != nil {
-				errorLogger.Println(fmt.Errorf("Error forwarding the request: err = %w", err))
+		records, err = parseZone(string(data), static.ttl, anyLabel)
+		if err != nil {
+			slog.Error("Failed to parse zone file", "path", zoneFile, "err", err)
+			os.Exit(1)
+		}
+	}
 
-				continue
+	// The metrics list the busiest clients even when nothing is warned about
+	var clients *clientCounter
+	if clientThreshold > 0 || metricsAddr != "" {
+		clients = newClientCounter(clientWindow, clientThreshold)
+	}
+
+	var stats *metrics
+	if metricsAddr != "" {
+		stats = newMetrics(clients)
+	}
+
+	var fwd *forwarder
+	if len(resolverArgs) > 0 {
+		fwd = &forwarder{
+			ednsBufSize:    ednsBufSize,
+			timeout:        upstreamTimeout,
+			budget:         defaultResolveBudget,
+			overrideTTL:    overrideTTL,
+			ttlOverrides:   ttlOverrides,
+			retries:        upstreamRetries,
+			metrics:        stats,
+			batchQuestions: batchQuestions,
+		}
+
+		for _, resolverArg := range resolverArgs {
+			spec, err := parseResolver(resolverArg)
+			if err != nil {
+				slog.Error("Failed to parse resolver address", "resolver", resolverArg, "err", err)
+				os.Exit(1)
 			}
 
-			response.answer = answers
-			response.header.setANCOUNT(uint16(len(answers)))
-		} else {
-			err = response.addStaticAnswer()
+			u, err := newUpstream(spec)
 			if err != nil {
-				errorLogger.Println(fmt.Errorf("Error while creating answer: err = %w", err))
-				continue
+				slog.Error("Failed to set up resolver", "resolver", resolverArg, "err", err)
+				os.Exit(1)
 			}
+
+			fwd.upstreams = append(fwd.upstreams, u)
+		}
+
+		if cacheSize > 0 {
+			fwd.cache = newAnswerCache(cacheSize, logCacheMisses)
+			fwd.cache.metrics = stats
 		}
+	}
+
+	srv := server{
+		forwarder:     fwd,
+		specialUse:    specialUse,
+		traced:        traced,
+		rootHints:     hints,
+		queryLog:      queryLog,
+		maxQuerySize:  maxQuerySize,
+		udpWorkers:    udpWorkers,
+		dnr:           dnr,
+		failClosed:    failClosed,
+		ednsBufSize:   ednsBufSize,
+		clients:       clients,
+		static:        &static,
+		zone:          records,
+		metrics:       stats,
+		noCompression: noCompression,
+	}
+
+	if probeOnStart {
+		err := srv.probe(context.Background())
+
+		switch {
+		case srv.forwarder == nil:
+			slog.Info("No resolver to probe, ready to serve")
+		case err == nil:
+			slog.Info("Probe succeeded, ready to serve")
+		case probeFatal:
+			slog.Error("Probe failed", "err", err)
+			os.Exit(1)
+		default:
+			slog.Warn("Probe failed, serving anyway", "err", err)
+		}
+	}
+
+	if noUDP && noTCP && unixPath == "" && dohAddr == "" {
+		slog.Error("No listener enabled, --no-udp and --no-tcp require --unix-listen or --doh-listen")
+		os.Exit(1)
+	}
+
+	if (dohCert == "") != (dohKey == "") {
+		slog.Error("--doh-cert and --doh-key go together")
+		os.Exit(2)
+	}
+
+	var wg sync.WaitGroup
 
-		serialized, err := response.serialize()
+	if stats != nil {
+		metricsListener, err := net.Listen("tcp", metricsAddr)
 		if err != nil {
-			errorLogger.Println(fmt.Errorf("Error serializing the message: err = %w", err))
-			continue
+			// The server is still useful without its metrics
+			slog.Error("Failed to bind the metrics endpoint", "address", metricsAddr, "err", err)
+		} else {
+			defer metricsListener.Close()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				stats.serve(metricsListener)
+			}()
 		}
+	}
 
-		_, err = udpConn.WriteToUDP(serialized, source)
+	if dohAddr != "" {
+		dohListener, err := net.Listen("tcp", dohAddr)
 		if err != nil {
-			errorLogger.Println(fmt.Errorf("Failed to send response: err = %w", err))
-			continue
+			slog.Error("Failed to bind the DoH listener", "address", dohAddr, "err", err)
+			os.Exit(1)
 		}
+		defer dohListener.Close()
 
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.serveDoH(dohListener, dohCert, dohKey)
+		}()
 	}
+
+	if unixPath != "" {
+		unixListener, err := listenUnix(unixPath)
+		if err != nil {
+			slog.Error("Failed to bind to unix socket", "path", unixPath, "err", err)
+			os.Exit(1)
+		}
+		defer unixListener.Close()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.serveStreamListener(unixListener)
+		}()
+	}
+
+	if !noUDP {
+		listener, err := listenUDP(listenAddress, buffers)
+		if err != nil {
+			// Unlike auxiliary listeners, the server is useless without its
+			// DNS listener. Exit with a failure status so supervisors notice.
+			slog.Error("Failed to bind to address", "address", listenAddress, "err", err)
+			os.Exit(1)
+		}
+		defer listener.conn.Close()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.serveUDP(listener)
+		}()
+	}
+
+	// RFC-7766 - 5 - TCP is a requirement, not a fallback option.
+	// Truncated UDP responses are retried over TCP on the same address.
+	if !noTCP {
+		tcpListener, err := net.Listen("tcp", listenAddress)
+		if err != nil {
+			slog.Error("Failed to bind to address", "address", listenAddress, "err", err)
+			os.Exit(1)
+		}
+		defer tcpListener.Close()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.serveStreamListener(tcpListener)
+		}()
+	}
+
+	wg.Wait()
 }
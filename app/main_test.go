@@ -0,0 +1,968 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+func TestSerializeRoundTrip(t *testing.T) {
+	response := createResponseMessage(newTestQuery(0x1234, "www.example.com", dnsmsg.A))
+	response.answer = []*RR{
+		newTestRR("www.example.com", dnsmsg.CNAME, 300, []byte("\x03cdn\x07example\x03com\x00")),
+		newTestRR("cdn.example.com", dnsmsg.A, 60, []byte{192, 0, 2, 1}),
+	}
+
+	for _, compress := range []bool{false, true} {
+		serialized, err := response.serializeWithin(0xFFFF, compress)
+		if err != nil {
+			t.Fatalf("Failed to serialize: %v", err)
+		}
+
+		parsed, err := deserialize(serialized)
+		if err != nil {
+			t.Fatalf("Failed to parse back, compress = %t: %v", compress, err)
+		}
+
+		assertMessage(t, response, parsed)
+	}
+}
+
+// Serializes `rr` as the single answer of a response and parses it back
+func roundTripRR(t *testing.T, rr *RR, compress bool) *RR {
+	t.Helper()
+
+	response := createResponseMessage(newTestQuery(0x1234, joinLabels(rr.NAME), rr.Type()))
+	response.answer = []*RR{rr}
+
+	serialized, err := response.serializeWithin(0xFFFF, compress)
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+
+	parsed, err := deserialize(serialized)
+	if err != nil {
+		t.Fatalf("Failed to parse back, compress = %t: %v", compress, err)
+	}
+
+	if len(parsed.answer) != 1 {
+		t.Fatalf("Expected 1 answer, got %d", len(parsed.answer))
+	}
+
+	return parsed.answer[0]
+}
+
+// Strings above 255 bytes are split over several <character-string>
+func TestTXTRoundTrip(t *testing.T) {
+	long := strings.Repeat("a", 300)
+
+	rr := newTestRR("example.com", dnsmsg.TXT, 300, nil)
+	if err := setTXT(rr, []string{"v=spf1 -all", "", long}); err != nil {
+		t.Fatalf("Failed to build TXT: %v", err)
+	}
+
+	parsed := roundTripRR(t, rr, true)
+
+	strs, ok := rdataTXT(parsed)
+	if !ok {
+		t.Fatalf("Failed to parse TXT RDATA %x", parsed.RDATA)
+	}
+
+	want := []string{"v=spf1 -all", "", long[:255], long[255:]}
+	if !slices.Equal(strs, want) {
+		t.Errorf("Expected %q, got %q", want, strs)
+	}
+}
+
+// Upstream servers compress MNAME and RNAME, the RDATA is decompressed so
+// it can be written in another message
+func TestSOARoundTrip(t *testing.T) {
+	want := &soa{
+		mname:   splitName("ns1.example.com"),
+		rname:   splitName("hostmaster.example.com"),
+		serial:  2024010101,
+		refresh: 7200,
+		retry:   900,
+		expire:  1209600,
+		minimum: 300,
+	}
+
+	rr := newTestRR("example.com", dnsmsg.SOA, 3600, nil)
+	if err := setSOA(rr, want); err != nil {
+		t.Fatalf("Failed to build SOA: %v", err)
+	}
+
+	for _, compress := range []bool{false, true} {
+		got, ok := rdataSOA(roundTripRR(t, rr, compress))
+		if !ok {
+			t.Fatalf("Failed to parse SOA RDATA, compress = %t", compress)
+		}
+
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("Expected %+v, got %+v, compress = %t", want, got, compress)
+		}
+	}
+
+	frame := testFrameHeader(1, 1)
+	frame = append(frame, "\x07example\x03com\x00\x00\x06\x00\x01"...)
+	frame = append(frame, 0xC0, 12, 0, byte(dnsmsg.SOA), 0, 1, 0, 0, 0x0E, 0x10, 0, 39)
+	frame = append(frame, "\x03ns1\xC0\x0C\x0Ahostmaster\xC0\x0C"...)
+	for _, field := range []uint32{want.serial, want.refresh, want.retry, want.expire, want.minimum} {
+		frame = binary.BigEndian.AppendUint32(frame, field)
+	}
+
+	response, err := deserialize(frame)
+	if err != nil {
+		t.Fatalf("Failed to parse compressed SOA: %v", err)
+	}
+
+	got, ok := rdataSOA(roundTripRR(t, response.answer[0], false))
+	if !ok || !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected %+v, got %+v from compressed RDATA", want, got)
+	}
+}
+
+// A dead primary used to spend the whole budget on its retries
+func TestExchangeBudgetSharedByUpstreams(t *testing.T) {
+	dead := startStubResolver(t, answerNothing)
+	healthy := startStubResolver(t, answerA)
+
+	f := newTestForwarder(t, dead.addr, healthy.addr)
+	f.timeout = time.Second
+	f.budget = time.Second
+	f.retries = 2
+
+	start := time.Now()
+	response, err := f.exchange(context.Background(), newTestQuery(1, "example.com", dnsmsg.A).question, 0)
+	if err != nil {
+		t.Fatalf("Failed to resolve through the secondary: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > f.budget {
+		t.Errorf("Resolved in %s, past the %s budget", elapsed, f.budget)
+	}
+
+	if len(response.answer) != 1 || healthy.queries.Load() != 1 {
+		t.Errorf("Expected 1 answer from 1 query to the secondary, got %d answers from %d queries", len(response.answer), healthy.queries.Load())
+	}
+}
+
+func TestFailoverToSecondary(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		primary func(*message) *message
+	}{
+		{"dead primary", answerNothing},
+		{"SERVFAIL primary", answerRCODE(dnsmsg.SERVFAIL)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			primary := startStubResolver(t, tc.primary)
+			secondary := startStubResolver(t, answerA)
+
+			s := newTestServer(newTestForwarder(t, primary.addr, secondary.addr))
+
+			query := newTestQuery(0x1234, "example.com", dnsmsg.A)
+			response := exchangeTest(t, s, query)
+
+			want := createResponseMessage(query)
+			want.header.SetRA(1)
+			want.answer = []*RR{newTestRR("example.com", dnsmsg.A, 300, []byte{192, 0, 2, 1})}
+
+			assertMessage(t, want, response)
+
+			if primary.queries.Load() == 0 || secondary.queries.Load() != 1 {
+				t.Errorf("Expected the primary then 1 query to the secondary, got %d and %d", primary.queries.Load(), secondary.queries.Load())
+			}
+		})
+	}
+}
+
+// Answers from memory, without a socket
+type mockTransport struct {
+	answer func(query *message) (*message, error)
+	// What the last attempt was given
+	deadline time.Time
+	bufSize  uint16
+}
+
+func (t *mockTransport) attempt(ctx context.Context, query *message, deadline time.Time, bufSize uint16, stats *metrics) (*message, error) {
+	t.deadline = deadline
+	t.bufSize = bufSize
+
+	return t.answer(query)
+}
+
+func TestForwardThroughMockTransport(t *testing.T) {
+	failing := &mockTransport{answer: func(*message) (*message, error) {
+		return nil, fmt.Errorf("Failed to connect to resolver")
+	}}
+	healthy := &mockTransport{answer: func(query *message) (*message, error) {
+		return answerA(query), nil
+	}}
+
+	f := newTestForwarder(t)
+	f.upstreams = []*upstream{
+		{protocol: "mock", address: "failing", transport: failing},
+		{protocol: "mock", address: "healthy", transport: healthy},
+	}
+
+	start := time.Now()
+	result, err := f.forwardResolve(context.Background(), newTestQuery(1, "example.com", dnsmsg.A).question, 0, 1)
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	end := time.Now()
+
+	want := []*RR{newTestRR("example.com", dnsmsg.A, 300, []byte{192, 0, 2, 1})}
+	if got := rrStrings(result.answers); len(got) != 1 || got[0] != rrString(want[0]) {
+		t.Errorf("Expected %v, got %v", rrStrings(want), got)
+	}
+
+	for _, mock := range []*mockTransport{failing, healthy} {
+		if mock.bufSize != f.ednsBufSize {
+			t.Errorf("Expected a %d bytes buffer, got %d", f.ednsBufSize, mock.bufSize)
+		}
+
+		if mock.deadline.Before(start) || mock.deadline.After(end.Add(f.timeout)) {
+			t.Errorf("Expected a deadline within the %s timeout, got %s", f.timeout, mock.deadline.Sub(start))
+		}
+	}
+}
+
+// A header for a frame with `qdcount` questions and `ancount` answers
+func testFrameHeader(qdcount byte, ancount byte) []byte {
+	return []byte{0x12, 0x34, 0x81, 0x80, 0, qdcount, 0, ancount, 0, 0, 0, 0}
+}
+
+// www.example.com CNAME cdn.example.com, the target compressed against the
+// question, and an A record whose owner points into that RDATA: a pointer
+// to a name that itself ends with a pointer
+func TestDecodeChainedPointers(t *testing.T) {
+	frame := testFrameHeader(1, 2)
+	frame = append(frame, "\x03www\x07example\x03com\x00\x00\x01\x00\x01"...)
+	frame = append(frame, 0xC0, 12, 0, byte(dnsmsg.CNAME), 0, 1, 0, 0, 0x01, 0x2C, 0, 6)
+	target := len(frame)
+	frame = append(frame, "\x03cdn\xC0\x10"...)
+	frame = append(frame, 0xC0, byte(target), 0, byte(dnsmsg.A), 0, 1, 0, 0, 0x01, 0x2C, 0, 4, 192, 0, 2, 1)
+
+	response, err := deserialize(frame)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	want := &message{header: response.header, question: newTestQuery(0, "www.example.com", dnsmsg.A).question}
+	want.answer = []*RR{
+		newTestRR("www.example.com", dnsmsg.CNAME, 300, []byte("\x03cdn\x07example\x03com\x00")),
+		newTestRR("cdn.example.com", dnsmsg.A, 300, []byte{192, 0, 2, 1}),
+	}
+
+	assertMessage(t, want, response)
+}
+
+// RFC-1035 - 4.1.4 - The offset takes 14 bits, a pointer past byte 255
+// has low bits in its first byte
+func TestDecodePointerPastByte255(t *testing.T) {
+	padding := append([]byte{255}, make([]byte, 255)...)
+	padding = append(padding, 63)
+	padding = append(padding, make([]byte, 63)...)
+
+	frame := testFrameHeader(1, 3)
+	frame = append(frame, "\x03www\x07example\x03com\x00\x00\x01\x00\x01"...)
+	frame = append(frame, 0xC0, 12, 0, byte(dnsmsg.TXT), 0, 1, 0, 0, 0x01, 0x2C)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(padding)))
+	frame = append(frame, padding...)
+
+	target := len(frame)
+	if target < 300 {
+		t.Fatalf("Target at offset %d, expected past 300", target)
+	}
+
+	frame = append(frame, "\x03cdn\xC0\x10"...)
+	frame = append(frame, 0, byte(dnsmsg.A), 0, 1, 0, 0, 0x01, 0x2C, 0, 4, 192, 0, 2, 1)
+	frame = append(frame, 0xC0|byte(target>>8), byte(target), 0, byte(dnsmsg.A), 0, 1, 0, 0, 0x01, 0x2C, 0, 4, 192, 0, 2, 2)
+
+	response, err := deserialize(frame)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	want := &message{header: response.header, question: newTestQuery(0, "www.example.com", dnsmsg.A).question}
+	want.answer = []*RR{
+		newTestRR("www.example.com", dnsmsg.TXT, 300, padding),
+		newTestRR("cdn.example.com", dnsmsg.A, 300, []byte{192, 0, 2, 1}),
+		newTestRR("cdn.example.com", dnsmsg.A, 300, []byte{192, 0, 2, 2}),
+	}
+
+	assertMessage(t, want, response)
+}
+
+// Our own compressed responses point owners at the questions
+func TestDecodeCompressedMultiQuestion(t *testing.T) {
+	query := newTestQuery(1, "a.example.com", dnsmsg.A)
+	query.question = append(query.question, newTestQuery(1, "b.example.com", dnsmsg.A).question...)
+	query.question = append(query.question, newTestQuery(1, "c.b.example.com", dnsmsg.A).question...)
+	query.header.SetQDCOUNT(3)
+
+	response := answerA(query)
+
+	serialized, err := response.serializeCompressed()
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+
+	parsed, err := deserialize(serialized)
+	if err != nil {
+		t.Fatalf("Failed to parse back: %v", err)
+	}
+
+	assertMessage(t, response, parsed)
+}
+
+// RFC-1035 - 3.5 - The labels of an in-addr.arpa name reach the resolver
+// as is, and the PTRDNAME of its answer comes back whole
+func TestForwardReversePointer(t *testing.T) {
+	var asked atomic.Value
+
+	stub := startStubResolver(t, func(query *message) *message {
+		asked.Store(slices.Clone(query.question[0].QNAME))
+
+		response := createResponseMessage(query)
+		response.header.SetRA(1)
+
+		rr := newTestRR(joinLabels(query.question[0].QNAME), dnsmsg.PTR, 300, nil)
+		if err := setPTR(rr, splitName("dns.example.net")); err != nil {
+			return nil
+		}
+		response.answer = []*RR{rr}
+
+		return response
+	})
+
+	f := newTestForwarder(t, stub.addr)
+
+	q := newTestQuery(1, "1.2.0.192.in-addr.arpa", dnsmsg.PTR).question[0]
+
+	result, err := f.forwardResolve(context.Background(), []*question{q}, 0, 1)
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+
+	want := []string{"1", "2", "0", "192", "in-addr", "arpa"}
+	if labels, _ := asked.Load().([]string); !slices.Equal(labels, want) {
+		t.Errorf("Expected the resolver to be asked %q, got %q", want, labels)
+	}
+
+	if len(result.answers) != 1 {
+		t.Fatalf("Expected 1 answer, got %d", len(result.answers))
+	}
+
+	target, ok := rdataPTR(result.answers[0])
+	if !ok || joinLabels(target) != "dns.example.net" {
+		t.Errorf("Expected PTR dns.example.net, got %q", target)
+	}
+}
+
+// The cache keeps an answer as long as the overridden TTL the client is told
+func TestTTLOverrideBeforeCaching(t *testing.T) {
+	stub := startStubResolver(t, answerA)
+
+	f := newTestForwarder(t, stub.addr)
+	f.cache = newAnswerCache(10, false)
+	f.ttlOverrides = map[string]uint32{"example.com": 3600}
+
+	q := newTestQuery(1, "example.com", dnsmsg.A).question[0]
+
+	result, err := f.forwardResolve(context.Background(), []*question{q}, 0, 1)
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+
+	if ttl := result.answers[0].TTLSeconds(); ttl != 3600 {
+		t.Errorf("Expected the overridden TTL 3600, got %d", ttl)
+	}
+
+	entry := f.cache.entries[newCacheKey(q)]
+	if lifetime := entry.expires.Sub(entry.storedAt); lifetime != 3600*time.Second {
+		t.Errorf("Expected the answer cached for 1h, got %s", lifetime)
+	}
+}
+
+// `--override-ttl` applies to every name, a per-name override wins over it
+func TestGlobalTTLOverride(t *testing.T) {
+	stub := startStubResolver(t, answerA)
+
+	overrideTTL := uint32(5)
+
+	f := newTestForwarder(t, stub.addr)
+	f.cache = newAnswerCache(10, false)
+	f.overrideTTL = &overrideTTL
+	f.ttlOverrides = map[string]uint32{"pinned.example.com": 3600}
+
+	for _, tc := range []struct {
+		name string
+		ttl  uint32
+	}{
+		{"example.com", 5},
+		{"other.example.net", 5},
+		{"pinned.example.com", 3600},
+	} {
+		q := newTestQuery(1, tc.name, dnsmsg.A).question[0]
+
+		result, err := f.forwardResolve(context.Background(), []*question{q}, 0, 1)
+		if err != nil {
+			t.Fatalf("Failed to resolve %s: %v", tc.name, err)
+		}
+
+		if ttl := result.answers[0].TTLSeconds(); ttl != tc.ttl {
+			t.Errorf("Expected a TTL of %d for %s, got %d", tc.ttl, tc.name, ttl)
+		}
+
+		entry := f.cache.entries[newCacheKey(q)]
+		if lifetime := entry.expires.Sub(entry.storedAt); lifetime != time.Duration(tc.ttl)*time.Second {
+			t.Errorf("Expected %s cached for %ds, got %s", tc.name, tc.ttl, lifetime)
+		}
+	}
+}
+
+func TestUpstreamNeverReplies(t *testing.T) {
+	stub := startStubResolver(t, answerNothing)
+	f := newTestForwarder(t, stub.addr)
+
+	start := time.Now()
+	_, err := f.exchange(context.Background(), newTestQuery(1, "example.com", dnsmsg.A).question, 0)
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+
+	// Every attempt times out, with the backoff between them
+	if limit := time.Duration(f.retries+1)*f.timeout + time.Second; elapsed > limit {
+		t.Errorf("Gave up after %s, expected less than %s", elapsed, limit)
+	}
+
+	if got := stub.queries.Load(); got != int32(f.retries+1) {
+		t.Errorf("Expected %d attempts, got %d", f.retries+1, got)
+	}
+}
+
+// `go test -fuzz FuzzDeserialize` explores further, the seeds and every
+// truncation of them run with the regular tests
+func FuzzDeserialize(f *testing.F) {
+	query, _ := newTestQuery(1, "www.example.com", dnsmsg.A).serialize()
+	response, _ := answerA(newTestQuery(1, "www.example.com", dnsmsg.A)).serializeCompressed()
+
+	for _, seed := range [][]byte{query, response} {
+		for size := 0; size <= len(seed); size++ {
+			f.Add(seed[:size])
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		// Must not panic, errors are expected
+		deserialize(frame)
+	})
+}
+
+// A CNAME and 4 addresses, as a CDN hosted name typically resolves
+func benchmarkResponse() *message {
+	response := createResponseMessage(newTestQuery(1, "www.example.com", dnsmsg.A))
+	response.answer = append(response.answer, newTestRR("www.example.com", dnsmsg.CNAME, 300, []byte("\x03cdn\x07example\x03net\x00")))
+
+	for i := byte(1); i <= 4; i++ {
+		response.answer = append(response.answer, newTestRR("cdn.example.net", dnsmsg.A, 60, []byte{192, 0, 2, i}))
+	}
+
+	response.additional = []*RR{newOPT(defaultEDNSBufSize)}
+
+	return response
+}
+
+func BenchmarkDeserialize(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		msg  *message
+	}{
+		{"query", newTestQuery(1, "www.example.com", dnsmsg.A)},
+		{"response", benchmarkResponse()},
+	} {
+		frame, err := bc.msg.serializeCompressed()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := deserialize(frame); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSerialize(b *testing.B) {
+	response := benchmarkResponse()
+
+	for _, compress := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compress=%t", compress), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := response.serializeWithin(maxUDPSize, compress); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// What every query costs us besides resolving it
+func BenchmarkRoundTrip(b *testing.B) {
+	frame, err := newTestQuery(1, "www.example.com", dnsmsg.A).serialize()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	answers := benchmarkResponse().answer
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		query, err := deserialize(frame)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		response := createResponseMessage(query)
+		response.answer = answers
+
+		if _, err := response.serializeWithin(maxUDPSize, true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestParseListenAddress(t *testing.T) {
+	tests := map[string]string{
+		"0.0.0.0:53":         "0.0.0.0:53",
+		"127.0.0.1":          "127.0.0.1:53",
+		"::1":                "[::1]:53",
+		"[::1]":              "[::1]:53",
+		"[2001:db8::1]:5353": "[2001:db8::1]:5353",
+	}
+
+	for addr, want := range tests {
+		got, err := parseListenAddress(addr)
+		if err != nil || got != want {
+			t.Errorf("parseListenAddress(%q) = %q, %v, want %q", addr, got, err, want)
+		}
+	}
+
+	for _, addr := range []string{"localhost:53", "127.0.0.1:0", "127.0.0.1:dns"} {
+		if _, err := parseListenAddress(addr); err == nil {
+			t.Errorf("parseListenAddress(%q) succeeded, want an error", addr)
+		}
+	}
+}
+
+// Forged datagrams before the real reply: a reply to another query and
+// garbage. Both are discarded, the attempt keeps reading.
+func TestUpstreamForgedReplies(t *testing.T) {
+	stub := startStubResolverFrames(t, func(query *message) [][]byte {
+		forged := answerA(query)
+		forged.header.SetID(query.header.ID() + 1)
+		forged.answer[0].SetData([]byte{203, 0, 113, 66})
+
+		forgedFrame, _ := forged.serialize()
+		real, _ := answerA(query).serialize()
+
+		return [][]byte{forgedFrame, []byte("garbage"), real}
+	})
+
+	f := newTestForwarder(t, stub.addr)
+
+	response, err := f.exchange(context.Background(), newTestQuery(1, "example.com", dnsmsg.A).question, 0)
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+
+	want := newTestRR("example.com", dnsmsg.A, 300, []byte{192, 0, 2, 1})
+	if len(response.answer) != 1 || rrString(response.answer[0]) != rrString(want) {
+		t.Errorf("Expected %s, got %v", rrString(want), rrStrings(response.answer))
+	}
+
+	if stub.queries.Load() != 1 {
+		t.Errorf("Expected a single attempt, got %d", stub.queries.Load())
+	}
+}
+
+// deserialize + createResponseMessage + serializeWithin(512, compressed)
+// with 4 answers, the numbers quoted by the pooling change. Only uses what
+// existed before it, so it can be run on both sides:
+// `go test -run - -bench QueryResponse -benchmem`
+func BenchmarkQueryResponse(b *testing.B) {
+	// www.example.com A, RD set
+	frame := []byte("\x12\x34\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00\x03www\x07example\x03com\x00\x00\x01\x00\x01")
+
+	answers := make([]*RR, 0, 4)
+	for i := byte(1); i <= 4; i++ {
+		rr := &RR{NAME: splitName("www.example.com")}
+		rr.SetType(dnsmsg.A)
+		rr.SetClass(dnsmsg.IN)
+		rr.SetTTL(60)
+		rr.SetData([]byte{192, 0, 2, i})
+		answers = append(answers, rr)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		query, err := deserialize(frame)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		response := createResponseMessage(query)
+		response.answer = answers
+		response.header.SetANCOUNT(uint16(len(answers)))
+
+		if _, err := response.serializeWithin(maxUDPSize, true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// The 13 root servers of named.root, with their glue
+func TestRootHints(t *testing.T) {
+	hints, err := parseRootHints(namedRoot)
+	if err != nil {
+		t.Fatalf("Failed to parse root hints: %v", err)
+	}
+
+	s := newTestServer(nil)
+	s.rootHints = hints
+
+	// Over a stream, nothing is truncated
+	response := exchangeTestOver(t, s, newTestQuery(0x1234, ".", dnsmsg.NS), false)
+
+	var names []string
+	for _, rr := range response.answer {
+		name, ok := rdataNS(rr)
+		if !ok || len(rr.NAME) != 0 {
+			t.Fatalf("Expected NS records of the root, got %s", rrString(rr))
+		}
+		names = append(names, joinLabels(name))
+	}
+
+	var want []string
+	for letter := 'A'; letter <= 'M'; letter++ {
+		want = append(want, string(letter)+".ROOT-SERVERS.NET")
+	}
+
+	if fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, names)
+	}
+
+	// Every server has its A and AAAA glue
+	if len(response.additional) != 26 {
+		t.Errorf("Expected 26 glue records, got %d", len(response.additional))
+	}
+
+	first := newTestRR("A.ROOT-SERVERS.NET", dnsmsg.A, 3600000, []byte{198, 41, 0, 4})
+	if len(response.additional) == 0 || rrString(response.additional[0]) != rrString(first) {
+		t.Errorf("Expected %s first, got %v", rrString(first), rrStrings(response.additional))
+	}
+}
+
+// Not a test on its own: runs main in the child processes of
+// `startMain`, with the arguments it was given
+func TestMainProcess(t *testing.T) {
+	args, ok := os.LookupEnv("DNS_TEST_MAIN_ARGS")
+	if !ok {
+		t.Skip("Only run as a child process")
+	}
+
+	os.Args = append([]string{os.Args[0]}, strings.Fields(args)...)
+	main()
+}
+
+// Written by the child process while the test reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+// The server as started from the command line, stopped with the test
+func startMain(t *testing.T, args ...string) *syncBuffer {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMainProcess$")
+	cmd.Env = append(os.Environ(), "DNS_TEST_MAIN_ARGS="+strings.Join(args, " "))
+
+	logs := new(syncBuffer)
+	cmd.Stderr = logs
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start the server: %v", err)
+	}
+
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	return logs
+}
+
+// A local address nothing listens on, for the UDP listener
+func freeUDPAddress(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().String()
+}
+
+// The metrics are auxiliary, the DNS listener comes up without them
+func TestMetricsPortInUse(t *testing.T) {
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to occupy a port: %v", err)
+	}
+	defer occupied.Close()
+
+	listen := freeUDPAddress(t)
+	logs := startMain(t, "--listen", listen, "--no-tcp", "--metrics-addr", occupied.Addr().String())
+
+	waitForServer(t, logs, func() error { return exchangeUDP(listen, 1, "example.com") })
+
+	if !strings.Contains(logs.String(), "Failed to bind the metrics endpoint") {
+		t.Errorf("Expected the bind failure to be logged, got:\n%s", logs)
+	}
+}
+
+// A disabled transport leaves its port free, the other one still answers
+func TestDisabledTransportNotBound(t *testing.T) {
+	t.Run("no-tcp", func(t *testing.T) {
+		listen := freeUDPAddress(t)
+		logs := startMain(t, "--listen", listen, "--no-tcp")
+
+		waitForServer(t, logs, func() error { return exchangeUDP(listen, 1, "example.com") })
+
+		tcpListener, err := net.Listen("tcp", listen)
+		if err != nil {
+			t.Fatalf("Expected TCP %s to be free: %v", listen, err)
+		}
+		tcpListener.Close()
+	})
+
+	t.Run("no-udp", func(t *testing.T) {
+		listen := freeUDPAddress(t)
+		logs := startMain(t, "--listen", listen, "--no-udp")
+
+		waitForServer(t, logs, func() error {
+			conn, err := net.Dial("tcp", listen)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			_, err = exchangeStream(conn, newTestQuery(1, "example.com", dnsmsg.A))
+			return err
+		})
+
+		udpConn, err := net.ListenPacket("udp", listen)
+		if err != nil {
+			t.Fatalf("Expected UDP %s to be free: %v", listen, err)
+		}
+		udpConn.Close()
+	})
+}
+
+// Retries `exchange` until the child process answers
+func waitForServer(t *testing.T, logs *syncBuffer, exchange func() error) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := exchange()
+		if err == nil {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("The server never answered: %v\n%s", err, logs)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// IPv4 and IPv6 resolvers are both accepted, bare or with a port
+func TestParseResolverAddress(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		want string
+	}{
+		{"8.8.8.8", "8.8.8.8:53"},
+		{"8.8.8.8:5353", "8.8.8.8:5353"},
+		{"::1", "[::1]:53"},
+		{"2001:4860:4860::8888", "[2001:4860:4860::8888]:53"},
+		{"[2001:4860:4860::8888]", "[2001:4860:4860::8888]:53"},
+		{"[2001:4860:4860::8888]:5353", "[2001:4860:4860::8888]:5353"},
+	} {
+		got, err := parseResolverAddress(tc.addr, "53")
+		if err != nil {
+			t.Errorf("Failed to parse %s: %v", tc.addr, err)
+			continue
+		}
+
+		if got != tc.want {
+			t.Errorf("Expected %s to give %s, got %s", tc.addr, tc.want, got)
+		}
+	}
+
+	for _, addr := range []string{"example.com", "8.8.8", "8.8.8.8:0", "8.8.8.8:65536", "[::1]:dns"} {
+		if got, err := parseResolverAddress(addr, "53"); err == nil {
+			t.Errorf("Expected %s to be rejected, got %s", addr, got)
+		}
+	}
+}
+
+func TestParseResolver(t *testing.T) {
+	for _, tc := range []struct {
+		entry      string
+		protocol   string
+		address    string
+		serverName string
+	}{
+		{"8.8.8.8", "udp", "8.8.8.8:53", ""},
+		{"udp://8.8.8.8:5353", "udp", "8.8.8.8:5353", ""},
+		{"tcp://8.8.8.8", "tcp", "8.8.8.8:53", ""},
+		{"tcp://[2001:4860:4860::8888]:5353", "tcp", "[2001:4860:4860::8888]:5353", ""},
+		{"tls://1.1.1.1#cloudflare-dns.com", "tls", "1.1.1.1:853", "cloudflare-dns.com"},
+		{"tls://1.1.1.1:8853", "tls", "1.1.1.1:8853", "1.1.1.1"},
+		{"https://dns.google", "https", "dns.google/dns-query", ""},
+		{"https://dns.google/resolve", "https", "dns.google/resolve", ""},
+	} {
+		spec, err := parseResolver(tc.entry)
+		if err != nil {
+			t.Errorf("parseResolver(%q) failed: %v", tc.entry, err)
+			continue
+		}
+
+		if spec.protocol != tc.protocol || spec.address != tc.address || spec.serverName != tc.serverName {
+			t.Errorf("parseResolver(%q) = %s %s %q, want %s %s %q", tc.entry, spec.protocol, spec.address, spec.serverName, tc.protocol, tc.address, tc.serverName)
+		}
+	}
+
+	for _, entry := range []string{"quic://8.8.8.8", "tcp://dns.google", "tls://", "https://"} {
+		if _, err := parseResolver(entry); err == nil {
+			t.Errorf("parseResolver(%q) succeeded, want an error", entry)
+		}
+	}
+}
+
+// Answers every query on a local TCP listener, one query per connection
+func startStubTCPResolver(t *testing.T, answer func(query *message) *message) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start stub resolver: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				frame, err := readStreamFrame(conn)
+				if err != nil {
+					return
+				}
+
+				query, err := deserialize(frame)
+				if err != nil {
+					return
+				}
+
+				serialized, err := answer(query).serialize()
+				if err != nil {
+					return
+				}
+
+				conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(serialized))), serialized...))
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestForwardOverTCP(t *testing.T) {
+	addr := startStubTCPResolver(t, answerA)
+	s := newTestServer(newTestForwarder(t, "tcp://"+addr))
+
+	query := newTestQuery(0x1234, "example.com", dnsmsg.A)
+	response := exchangeTest(t, s, query)
+
+	want := createResponseMessage(query)
+	want.header.SetRA(1)
+	want.answer = []*RR{newTestRR("example.com", dnsmsg.A, 300, []byte{192, 0, 2, 1})}
+
+	assertMessage(t, want, response)
+}
+
+// Without a resolver, SERVFAIL instead of the static answer
+func TestFailClosed(t *testing.T) {
+	s := newTestServer(nil)
+	s.failClosed = true
+
+	for _, qtype := range []uint16{dnsmsg.A, dnsmsg.AAAA, dnsmsg.MX} {
+		query := newTestQuery(0x1234, "example.com", qtype)
+		response := exchangeTest(t, s, query)
+
+		want := createResponseMessage(query)
+		want.header.SetRCODE(dnsmsg.SERVFAIL)
+
+		assertMessage(t, want, response)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counters served in the Prometheus text format on `--metrics-addr`.
+// Every method is a no-op on a nil `*metrics`, instrumented code does not
+// need to know whether metrics are enabled.
+type metrics struct {
+	queries atomic.Uint64
+	// By RCODE, the 4 bits of the header
+	responses [16]atomic.Uint64
+	// Frames that could not be decoded, by who sent them
+	clientParseFailures   atomic.Uint64
+	upstreamParseFailures atomic.Uint64
+	cacheHits             atomic.Uint64
+	cacheMisses           [cacheMissErrorRCODE + 1]atomic.Uint64
+
+	mu sync.Mutex
+	// By upstream address
+	upstreamLatency map[string]*histogram
+	upstreamErrors  map[string]uint64
+
+	// nil unless per-client counters are enabled
+	clients *clientCounter
+}
+
+// Clients listed with their query count
+const metricsTopClients = 10
+
+// Upper bounds, in seconds, of the upstream latency buckets
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type histogram struct {
+	// Not cumulative, summed up when written
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newMetrics(clients *clientCounter) *metrics {
+	return &metrics{
+		upstreamLatency: make(map[string]*histogram),
+		upstreamErrors:  make(map[string]uint64),
+		clients:         clients,
+	}
+}
+
+func (m *metrics) query(rcode uint8) {
+	if m == nil {
+		return
+	}
+
+	m.queries.Add(1)
+	m.responses[rcode&0b1111].Add(1)
+}
+
+func (m *metrics) clientParseFailure() {
+	if m == nil {
+		return
+	}
+
+	m.clientParseFailures.Add(1)
+}
+
+func (m *metrics) upstreamParseFailure() {
+	if m == nil {
+		return
+	}
+
+	m.upstreamParseFailures.Add(1)
+}
+
+func (m *metrics) cacheHit() {
+	if m == nil {
+		return
+	}
+
+	m.cacheHits.Add(1)
+}
+
+func (m *metrics) cacheMiss(reason cacheMissReason) {
+	if m == nil || int(reason) >= len(m.cacheMisses) {
+		return
+	}
+
+	m.cacheMisses[reason].Add(1)
+}
+
+// Includes retries, failed exchanges are counted as errors as well
+func (m *metrics) upstreamExchange(upstream string, latency time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.upstreamLatency[upstream]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.upstreamLatency[upstream] = h
+	}
+
+	h.observe(latency.Seconds())
+
+	if err != nil {
+		m.upstreamErrors[upstream]++
+	}
+}
+
+func (h *histogram) observe(value float64) {
+	h.sum += value
+	h.count++
+
+	for i, bound := range latencyBuckets {
+		if value <= bound {
+			h.counts[i]++
+			return
+		}
+	}
+}
+
+func (m *metrics) write(w io.Writer) {
+	fmt.Fprintln(w, "# HELP dns_queries_total Queries answered.")
+	fmt.Fprintln(w, "# TYPE dns_queries_total counter")
+	fmt.Fprintf(w, "dns_queries_total %d\n", m.queries.Load())
+
+	fmt.Fprintln(w, "# HELP dns_responses_total Responses by RCODE.")
+	fmt.Fprintln(w, "# TYPE dns_responses_total counter")
+	for rcode := range m.responses {
+		if count := m.responses[rcode].Load(); count > 0 {
+			fmt.Fprintf(w, "dns_responses_total{rcode=\"%d\"} %d\n", rcode, count)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP dns_parse_failures_total Frames that could not be decoded.")
+	fmt.Fprintln(w, "# TYPE dns_parse_failures_total counter")
+	fmt.Fprintf(w, "dns_parse_failures_total{source=\"client\"} %d\n", m.clientParseFailures.Load())
+	fmt.Fprintf(w, "dns_parse_failures_total{source=\"upstream\"} %d\n", m.upstreamParseFailures.Load())
+
+	fmt.Fprintln(w, "# HELP dns_cache_hits_total Questions answered from the cache.")
+	fmt.Fprintln(w, "# TYPE dns_cache_hits_total counter")
+	fmt.Fprintf(w, "dns_cache_hits_total %d\n", m.cacheHits.Load())
+
+	fmt.Fprintln(w, "# HELP dns_cache_misses_total Questions not answered from the cache, by reason.")
+	fmt.Fprintln(w, "# TYPE dns_cache_misses_total counter")
+	for reason := cacheMissCold; reason <= cacheMissErrorRCODE; reason++ {
+		fmt.Fprintf(w, "dns_cache_misses_total{reason=%q} %d\n", reason, m.cacheMisses[reason].Load())
+	}
+
+	m.writeUpstreams(w)
+
+	if m.clients != nil {
+		fmt.Fprintln(w, "# HELP dns_client_queries Estimated queries over the last client window, for the busiest clients.")
+		fmt.Fprintln(w, "# TYPE dns_client_queries gauge")
+		for _, rate := range m.clients.top(metricsTopClients) {
+			fmt.Fprintf(w, "dns_client_queries{client=%q} %d\n", rate.client, rate.queries)
+		}
+	}
+}
+
+func (m *metrics) writeUpstreams(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upstreams := make([]string, 0, len(m.upstreamLatency))
+	for upstream := range m.upstreamLatency {
+		upstreams = append(upstreams, upstream)
+	}
+	sort.Strings(upstreams)
+
+	fmt.Fprintln(w, "# HELP dns_upstream_errors_total Exchanges with an upstream that failed after all retries.")
+	fmt.Fprintln(w, "# TYPE dns_upstream_errors_total counter")
+	for _, upstream := range upstreams {
+		fmt.Fprintf(w, "dns_upstream_errors_total{upstream=%q} %d\n", upstream, m.upstreamErrors[upstream])
+	}
+
+	fmt.Fprintln(w, "# HELP dns_upstream_latency_seconds Time spent on an exchange with an upstream, retries included.")
+	fmt.Fprintln(w, "# TYPE dns_upstream_latency_seconds histogram")
+	for _, upstream := range upstreams {
+		h := m.upstreamLatency[upstream]
+
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "dns_upstream_latency_seconds_bucket{upstream=%q,le=%q} %d\n", upstream, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "dns_upstream_latency_seconds_bucket{upstream=%q,le=\"+Inf\"} %d\n", upstream, h.count)
+		fmt.Fprintf(w, "dns_upstream_latency_seconds_sum{upstream=%q} %g\n", upstream, h.sum)
+		fmt.Fprintf(w, "dns_upstream_latency_seconds_count{upstream=%q} %d\n", upstream, h.count)
+	}
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+// Metrics are auxiliary, failing to serve them does not stop the server
+func (m *metrics) serve(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+
+	err := http.Serve(listener, mux)
+	if err != nil {
+		slog.Error("Metrics server stopped", "err", err)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import "sync"
+
+// Allocations made for every query are reused across queries to spare the
+// GC under load. Only buffers whose lifetime ends with the query are pooled,
+// messages and records are not: responses are kept in the cache and shared
+// between the clients of an in-flight question.
+
+// UDP datagrams, copied out of the read buffer for a worker
+var framePool = sync.Pool{
+	New: func() any { return new([]byte) },
+}
+
+func getFrame(data []byte) *[]byte {
+	frame := framePool.Get().(*[]byte)
+	*frame = append((*frame)[:0], data...)
+
+	return frame
+}
+
+// The frame must not be referenced anymore, the parsed query included
+func putFrame(frame *[]byte) {
+	framePool.Put(frame)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+// With `--probe-on-start`, a query for a well-known name goes through the
+// whole pipeline, upstream included, before we start serving.
+// Misconfigurations such as an unreachable resolver show up right away
+// instead of on the first real query.
+// Without a resolver there is nothing to reach: answers come from the zone
+// file, the hosts file or the static answer, which need not know the probe
+// name.
+const probeTimeout = 5 * time.Second
+
+var probeName = []string{"a", "root-servers", "net"}
+
+func (s *server) probe(ctx context.Context) error {
+	if s.forwarder == nil {
+		return nil
+	}
+
+	query := message{
+		header:   new(header),
+		question: []*question{{QNAME: probeName}},
+	}
+
+	query.question[0].SetType(dnsmsg.A)
+	query.question[0].SetClass(dnsmsg.IN)
+	query.header.SetID(random.uint16())
+	query.header.SetRD(1)
+	query.header.SetQDCOUNT(1)
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	response, err := s.handle(ctx, &query)
+	if err != nil {
+		return err
+	}
+
+	serialized, err := response.serialize()
+	if err != nil {
+		return fmt.Errorf("Failed to serialize the probe response: err = %w", err)
+	}
+
+	parsed, err := deserialize(serialized)
+	if err != nil {
+		return fmt.Errorf("Failed to parse the probe response: err = %w", err)
+	}
+
+	if parsed.header.RCODE() != dnsmsg.NOERROR {
+		return fmt.Errorf("probe answered with RCODE %d", parsed.header.RCODE())
+	}
+
+	if len(parsed.answer) == 0 {
+		return fmt.Errorf("probe got no answer for %s", joinLabels(probeName))
+	}
+
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+func TestProbe(t *testing.T) {
+	z, err := parseZone(testZone, 60, false)
+	if err != nil {
+		t.Fatalf("Failed to parse zone: %v", err)
+	}
+
+	local := newTestServer(nil)
+	local.zone = z
+
+	if err := local.probe(context.Background()); err != nil {
+		t.Errorf("Probe failed without a resolver: %v", err)
+	}
+
+	healthy := startStubResolver(t, answerA)
+	if err := newTestServer(newTestForwarder(t, healthy.addr)).probe(context.Background()); err != nil {
+		t.Errorf("Probe failed against a healthy resolver: %v", err)
+	}
+
+	broken := startStubResolver(t, answerRCODE(dnsmsg.SERVFAIL))
+	if err := newTestServer(newTestForwarder(t, broken.addr)).probe(context.Background()); err == nil {
+		t.Errorf("Probe succeeded against a resolver answering SERVFAIL")
+	}
+}
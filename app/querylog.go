@@ -0,0 +1,21 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+)
+
+// One line per answered query, enabled by `--query-log`.
+// The size and TC bit of the final frame help correlating client side
+// failures with oversized responses.
+func logQuery(ctx context.Context, client net.Addr, response *message, size int) {
+	slog.InfoContext(ctx, "Query",
+		"client", client,
+		"questions", response.questionNames(),
+		"rcode", response.header.RCODE(),
+		"answers", rrStrings(response.answer),
+		"size", size,
+		"tc", response.header.TC(),
+	)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"math/rand/v2"
+	"sync"
+)
+
+// Query IDs must be unpredictable, see RFC-5452 - 9.2.
+// The source is swappable so tests can be deterministic. A `*rand.Rand` is
+// not safe for concurrent use, every access goes through the mutex since
+// queries are resolved concurrently.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newLockedRand(src rand.Source) *lockedRand {
+	return &lockedRand{r: rand.New(src)}
+}
+
+func (l *lockedRand) uint16() uint16 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return uint16(l.r.UintN(1 << 16))
+}
+
+func (l *lockedRand) uint64() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.r.Uint64()
+}
+
+var random = newLockedRand(rand.NewChaCha8(seed()))
+
+func seed() [32]byte {
+	var s [32]byte
+
+	for i := 0; i < len(s); i += 8 {
+		v := rand.Uint64()
+		for j := 0; j < 8; j++ {
+			s[i+j] = byte(v >> (8 * j))
+		}
+	}
+
+	return s
+}
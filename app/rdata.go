@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+// Human readable RDATA for logs, close to the master file format of
+// RFC-1035 - 5.1. Anything we cannot decode is printed in the generic
+// format of RFC-3597 - 5.
+func rdataString(rr *RR) string {
+	data := rr.RDATA
+
+	switch rr.Type() {
+	case dnsmsg.A, dnsmsg.AAAA:
+		if ip, ok := netip.AddrFromSlice(data); ok && (len(data) == 4) == (rr.Type() == dnsmsg.A) {
+			return ip.String()
+		}
+	case dnsmsg.NS, dnsmsg.CNAME, dnsmsg.PTR:
+		if name, ok := rdataName(data, 0); ok {
+			return name
+		}
+	case dnsmsg.MX:
+		if preference, exchange, ok := rdataMX(rr); ok {
+			return fmt.Sprintf("%d %s.", preference, strings.TrimSuffix(joinLabels(exchange), "."))
+		}
+	case dnsmsg.SRV:
+		if len(data) > 6 {
+			if name, ok := rdataName(data, 6); ok {
+				return fmt.Sprintf("%d %d %d %s",
+					binary.BigEndian.Uint16(data[0:2]),
+					binary.BigEndian.Uint16(data[2:4]),
+					binary.BigEndian.Uint16(data[4:6]),
+					name)
+			}
+		}
+	case dnsmsg.TXT:
+		if s, ok := txtString(rr); ok {
+			return s
+		}
+	case dnsmsg.CAA:
+		if record, ok := rdataCAA(rr); ok {
+			return record.String()
+		}
+	case dnsmsg.SOA:
+		if s, ok := soaString(rr); ok {
+			return s
+		}
+	}
+
+	return fmt.Sprintf("\\# %d %s", len(data), hex.EncodeToString(data))
+}
+
+// A whole record, `name TTL CLASS TYPE RDATA`
+func rrString(rr *RR) string {
+	return fmt.Sprintf("%s. %d %s %s %s",
+		strings.TrimSuffix(joinLabels(rr.NAME), "."),
+		binary.BigEndian.Uint32(rr.TTL[:]),
+		dnsmsg.ClassName(rr.Class()),
+		dnsmsg.RRTypeName(rr.Type()),
+		rdataString(rr))
+}
+
+func rrStrings(rrs []*RR) []string {
+	strs := make([]string, 0, len(rrs))
+
+	for _, rr := range rrs {
+		strs = append(strs, rrString(rr))
+	}
+
+	return strs
+}
+
+// Decodes an uncompressed name starting at `head`, and makes sure nothing
+// follows it
+func rdataName(data []byte, head int) (string, bool) {
+	labels, end, ok := rdataLabels(data, head)
+	if !ok || end != len(data) {
+		return "", false
+	}
+
+	return strings.TrimSuffix(joinLabels(labels), ".") + ".", true
+}
+
+func rdataLabels(data []byte, head int) ([]string, int, bool) {
+	labels := make([]string, 0)
+
+	for head < len(data) {
+		length := int(data[head])
+		head++
+
+		if length == 0 {
+			return labels, head, true
+		}
+
+		// Compression pointers only make sense within their frame
+		if length > 63 || head+length > len(data) {
+			return nil, 0, false
+		}
+
+		labels = append(labels, string(data[head:head+length]))
+		head += length
+	}
+
+	return nil, 0, false
+}
+
+// RFC-1035 - 3.3.14 - One or more <character-string>
+func txtString(rr *RR) (string, bool) {
+	txt, ok := rdataTXT(rr)
+	if !ok {
+		return "", false
+	}
+
+	strs := make([]string, 0, len(txt))
+
+	for _, str := range txt {
+		strs = append(strs, strconv.Quote(str))
+	}
+
+	return strings.Join(strs, " "), true
+}
+
+// RFC-1035 - 3.3.13 - MNAME RNAME SERIAL REFRESH RETRY EXPIRE MINIMUM
+func soaString(rr *RR) (string, bool) {
+	record, ok := rdataSOA(rr)
+	if !ok {
+		return "", false
+	}
+
+	return fmt.Sprintf("%s. %s. %d %d %d %d %d",
+		strings.TrimSuffix(joinLabels(record.mname), "."),
+		strings.TrimSuffix(joinLabels(record.rname), "."),
+		record.serial, record.refresh, record.retry, record.expire, record.minimum), true
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+// Some clients bootstrap by asking for the NS records of the root.
+// With `--serve-root-hints` we answer that query ourselves, with the glue
+// records in the additional section, instead of forwarding it.
+//
+//go:embed named.root
+var namedRoot string
+
+type rootHints struct {
+	ns   []*RR
+	glue addressBook
+}
+
+func parseRootHints(data string) (*rootHints, error) {
+	hints := &rootHints{glue: make(addressBook)}
+
+	for n, line := range strings.Split(data, "\n") {
+		line, _, _ = strings.Cut(line, ";")
+		fields := strings.Fields(line)
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid root hint on line %d", n+1)
+		}
+
+		ttl, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TTL on line %d: %w", n+1, err)
+		}
+
+		rr := new(RR)
+		rr.NAME = splitName(fields[0])
+		rr.SetClass(dnsmsg.IN)
+		rr.SetTTL(uint32(ttl))
+
+		rrtype, _ := dnsmsg.RRTypeByName(fields[2])
+
+		switch rrtype {
+		case dnsmsg.NS:
+			data, err := dnsmsg.EncodeName(splitName(fields[3]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid NS on line %d: %w", n+1, err)
+			}
+
+			rr.SetType(dnsmsg.NS)
+			rr.SetData(data)
+			hints.ns = append(hints.ns, rr)
+		case dnsmsg.A, dnsmsg.AAAA:
+			ip, err := netip.ParseAddr(fields[3])
+			if err != nil || ip.Is4() != (rrtype == dnsmsg.A) {
+				return nil, fmt.Errorf("invalid %s on line %d", fields[2], n+1)
+			}
+
+			rr.SetType(rrtype)
+			rr.SetData(ip.AsSlice())
+			hints.glue.add(rr)
+		default:
+			return nil, fmt.Errorf("unsupported type %s on line %d", fields[2], n+1)
+		}
+	}
+
+	return hints, nil
+}
+
+func (m *message) isRootNSQuery() bool {
+	if len(m.question) != 1 {
+		return false
+	}
+
+	q := m.question[0]
+
+	return len(q.QNAME) == 0 && q.Type() == dnsmsg.NS && q.Class() == dnsmsg.IN
+}
+
+func (m *message) addRootHints(hints *rootHints) {
+	m.answer = append(m.answer, hints.ns...)
+	m.header.SetANCOUNT(uint16(len(m.answer)))
+
+	m.addGlue(hints.glue)
+}
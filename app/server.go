@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+// Everything needed to turn a query into a response, shared by every
+// listener.
+type server struct {
+	// nil when not in forwarder mode
+	forwarder *forwarder
+	// nil when special-use domains are disabled
+	specialUse specialUseTable
+	// Names whose queries are traced end-to-end
+	traced traceNames
+	// nil unless per-client counters are enabled
+	clients *clientCounter
+	static  *staticAnswer
+	// nil unless root NS queries are answered locally
+	rootHints *rootHints
+	queryLog  bool
+	// Larger queries are not processed at all
+	maxQuerySize int
+	// Goroutines handling UDP queries
+	udpWorkers int
+	// SVCB RDATA advertised for `_dns.resolver.arpa`, nil to forward it
+	dnr [][]byte
+	// nil unless answering authoritatively from a zone file
+	zone *zone
+	// Without a resolver, answer SERVFAIL rather than the static answer
+	failClosed bool
+	// Advertised in the OPT record of our responses
+	ednsBufSize uint16
+	// Write names in full, as before compression was implemented
+	noCompression bool
+	// nil unless metrics are served
+	metrics *metrics
+}
+
+// Queries never get close to this in practice, larger ones are either
+// broken or abusive.
+const defaultMaxQuerySize = 512
+
+// A FORMERR response for a frame we refuse to parse.
+// Only the header is echoed, with every section emptied.
+// Returns nil when the frame does not even hold a header.
+func formatError(frame []byte) []byte {
+	if len(frame) < 12 {
+		return nil
+	}
+
+	response := new(header)
+	copy(response[:], frame)
+
+	response.SetQR(1)
+	response.SetRCODE(dnsmsg.FORMERR)
+	response.SetQDCOUNT(0)
+	response.SetANCOUNT(0)
+	response.SetNSCOUNT(0)
+	response.SetARCOUNT(0)
+
+	return response[:]
+}
+
+// Everything between receiving a frame and sending the response back,
+// whatever the transport. The response is truncated to `maxSize` bytes.
+// Returns nil when there is nothing to send back, the response message is
+// returned along the frame.
+// Over UDP, the response must fit in what the client can reassemble
+func (s *server) serveFrame(frame []byte, client net.Addr, udp bool) ([]byte, *message) {
+	start := time.Now()
+
+	incomingMessage, err := deserialize(frame)
+	if err != nil {
+		slog.Warn("Failed to parse query", "client", client, "size", len(frame), "err", err)
+		s.metrics.clientParseFailure()
+		return nil, nil
+	}
+
+	// Streams are only limited by their 2 bytes length prefix
+	maxSize := 0xFFFF
+	if udp {
+		maxSize = s.maxUDPResponseSize(incomingMessage)
+	}
+
+	ctx := s.queryContext(context.Background(), incomingMessage)
+
+	// Forwarding failures already come back as SERVFAIL. Any other failure
+	// is answered the same way rather than leaving the client waiting for
+	// its own timeout.
+	response, err := s.handle(ctx, incomingMessage)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to handle query", "client", client, "questions", incomingMessage.questionNames(), "err", err)
+		response = createResponseMessage(incomingMessage)
+		response.header.SetRCODE(dnsmsg.SERVFAIL)
+	}
+
+	serialized, err := response.serializeWithin(maxSize, !s.noCompression)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to serialize response", "client", client, "questions", incomingMessage.questionNames(), "err", err)
+		return nil, nil
+	}
+
+	trace(ctx, "Sending response", "client", client, "size", len(serialized))
+
+	s.metrics.query(response.header.RCODE())
+
+	slog.DebugContext(ctx, "Answered query",
+		"client", client,
+		"questions", response.questionNames(),
+		"types", response.questionTypes(),
+		"rcode", response.header.RCODE(),
+		"size", len(serialized),
+		"latency", time.Since(start),
+	)
+
+	if s.queryLog {
+		logQuery(ctx, client, response, len(serialized))
+	}
+
+	return serialized, response
+}
+
+// RFC-6891 - 7 - An EDNS client tells how large a response it can take.
+// We never go above the size we advertise ourselves.
+func (s *server) maxUDPResponseSize(query *message) int {
+	size, ok := query.udpPayloadSize()
+	if !ok {
+		return maxUDPSize
+	}
+
+	return int(min(size, s.ednsBufSize))
+}
+
+// Request-scoped context for an incoming query
+func (s *server) queryContext(ctx context.Context, incomingMessage *message) context.Context {
+	if s.traced.match(incomingMessage) {
+		return withTrace(ctx)
+	}
+
+	return ctx
+}
+
+func (s *server) handle(ctx context.Context, incomingMessage *message) (*message, error) {
+	if size, ok := incomingMessage.udpPayloadSize(); ok {
+		trace(ctx, "Received query", "id", incomingMessage.header.ID(), "questions", incomingMessage.questionNames(), "udp_payload_size", size)
+	} else {
+		trace(ctx, "Received query", "id", incomingMessage.header.ID(), "questions", incomingMessage.questionNames())
+	}
+
+	response := createResponseMessage(incomingMessage)
+
+	err := response.addOPTFor(incomingMessage, s.ednsBufSize)
+	if err != nil {
+		trace(ctx, "Invalid OPT record", "err", err)
+		response.header.SetRCODE(dnsmsg.FORMERR)
+		return response, nil
+	}
+
+	// IQUERY, STATUS and others have nothing to resolve, the questions are
+	// echoed as is with NOTIMP
+	if response.header.RCODE() == dnsmsg.NOTIMP {
+		trace(ctx, "Unsupported opcode", "opcode", incomingMessage.header.OPCODE())
+		return response, nil
+	}
+
+	// A query without a question cannot be answered, RFC-1035 - 4.1.1
+	if len(incomingMessage.question) == 0 {
+		trace(ctx, "Query without a question")
+		response.header.SetRCODE(dnsmsg.FORMERR)
+		return response, nil
+	}
+
+	// We only offer recursion when we have someone to recurse to
+	if s.forwarder != nil {
+		response.header.SetRA(1)
+	}
+
+	// RFC-5936 - 2.2.1 & RFC-1995
+	// A forwarder has no zone to transfer, forwarding the transfer is
+	// pointless at best and an amplification vector at worst.
+	if incomingMessage.hasZoneTransfer() {
+		response.header.SetRCODE(dnsmsg.REFUSED)
+		trace(ctx, "Refused zone transfer")
+		return response, nil
+	}
+
+	if s.rootHints != nil && incomingMessage.isRootNSQuery() {
+		response.addRootHints(s.rootHints)
+		trace(ctx, "Answered root NS query from root hints")
+		return response, nil
+	}
+
+	if s.dnr != nil && incomingMessage.isDNRQuery() {
+		response.addDNRAnswers(s.dnr)
+		trace(ctx, "Answered resolver discovery query")
+		return response, nil
+	}
+
+	questions := response.question
+
+	if s.specialUse != nil {
+		questions, err = response.addSpecialUseAnswers(s.specialUse, s.static)
+		if err != nil {
+			return nil, fmt.Errorf("Error while creating special-use answer: err = %w", err)
+		}
+
+		trace(ctx, "Answered special-use names", "remaining", len(questions), "answers", len(response.answer))
+	}
+
+	if s.forwarder != nil {
+		result, err := s.forwarder.forwardResolve(ctx, questions, incomingMessage.header.CD(), incomingMessage.header.RD())
+		// Some questions may have been resolved before another one failed.
+		// The client gets what we have, flagged as a server failure, or
+		// as refused when it did not want us to recurse.
+		if errors.Is(err, errNotCached) {
+			trace(ctx, "Not in the cache, recursion not desired", "answers", len(result.answers))
+			response.header.SetRCODE(dnsmsg.REFUSED)
+		} else if err != nil {
+			trace(ctx, "Forwarding failed", "err", err, "answers", len(result.answers))
+			slog.WarnContext(ctx, "Failed to forward query", "questions", incomingMessage.questionNames(), "err", err)
+			response.header.SetRCODE(dnsmsg.SERVFAIL)
+		} else if result.rcode != dnsmsg.NOERROR && response.header.RCODE() == dnsmsg.NOERROR {
+			response.header.SetRCODE(result.rcode)
+		}
+
+		response.answer = append(response.answer, result.answers...)
+		response.header.SetANCOUNT(uint16(len(response.answer)))
+		response.authority = append(response.authority, result.authority...)
+		response.header.SetNSCOUNT(uint16(len(response.authority)))
+
+		// Answers we made up locally are not authenticated
+		if len(questions) == len(response.question) {
+			response.header.SetAD(result.authenticData)
+		}
+	} else if s.zone != nil {
+		response.addZoneAnswers(s.zone, questions)
+		trace(ctx, "Answered from the zone")
+	} else if s.failClosed {
+		// Fabricated answers are worse than no answer in production
+		if len(questions) > 0 {
+			response.header.SetRCODE(dnsmsg.SERVFAIL)
+		}
+
+		trace(ctx, "No resolver configured, failing closed")
+	} else {
+		err := response.addStaticAnswer(questions, s.static)
+		if err != nil {
+			return nil, fmt.Errorf("Error while creating answer: err = %w", err)
+		}
+
+		trace(ctx, "Answered with static answer")
+	}
+
+	trace(ctx, "Built response", "rcode", response.header.RCODE(), "answers", rrStrings(response.answer), "authority", rrStrings(response.authority))
+
+	return response, nil
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+func TestZoneTransferRefused(t *testing.T) {
+	for _, qtype := range []uint16{dnsmsg.AXFR, dnsmsg.IXFR} {
+		t.Run(dnsmsg.RRTypeName(qtype), func(t *testing.T) {
+			stub := startStubResolver(t, answerA)
+			s := newTestServer(newTestForwarder(t, stub.addr))
+
+			query := newTestQuery(0x1234, "example.com", qtype)
+			response := exchangeTest(t, s, query)
+
+			want := createResponseMessage(query)
+			want.header.SetRA(1)
+			want.header.SetRCODE(dnsmsg.REFUSED)
+
+			assertMessage(t, want, response)
+
+			if stub.queries.Load() != 0 {
+				t.Errorf("The zone transfer was forwarded")
+			}
+		})
+	}
+}
+
+func TestUpstreamRCODEPropagated(t *testing.T) {
+	stub := startStubResolver(t, answerRCODE(dnsmsg.NXDOMAIN))
+	s := newTestServer(newTestForwarder(t, stub.addr))
+
+	query := newTestQuery(0x1234, "missing.example.com", dnsmsg.A)
+	response := exchangeTest(t, s, query)
+
+	want := createResponseMessage(query)
+	want.header.SetRA(1)
+	want.header.SetRCODE(dnsmsg.NXDOMAIN)
+
+	assertMessage(t, want, response)
+}
+
+// The client gets SERVFAIL with its question right away instead of waiting
+// for its own timeout
+func TestFailingUpstreamAnswersSERVFAIL(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		answer func(*message) *message
+	}{
+		{"dead", answerNothing},
+		{"SERVFAIL", answerRCODE(dnsmsg.SERVFAIL)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stub := startStubResolver(t, tc.answer)
+			s := newTestServer(newTestForwarder(t, stub.addr))
+
+			query := newTestQuery(0x1234, "example.com", dnsmsg.A)
+			response := exchangeTest(t, s, query)
+
+			want := createResponseMessage(query)
+			want.header.SetRA(1)
+			want.header.SetRCODE(dnsmsg.SERVFAIL)
+
+			assertMessage(t, want, response)
+		})
+	}
+}
+
+// Without RD only the cache answers, REFUSED until the name was asked with RD
+func TestRecursionDesired(t *testing.T) {
+	stub := startStubResolver(t, answerA)
+
+	f := newTestForwarder(t, stub.addr)
+	f.cache = newAnswerCache(10, false)
+	s := newTestServer(f)
+
+	nonRecursive := newTestQuery(0x1234, "example.com", dnsmsg.A)
+	nonRecursive.header.SetRD(0)
+
+	want := createResponseMessage(nonRecursive)
+	want.header.SetRA(1)
+	want.header.SetRCODE(dnsmsg.REFUSED)
+
+	assertMessage(t, want, exchangeTest(t, s, nonRecursive))
+
+	if stub.queries.Load() != 0 {
+		t.Fatalf("A query without RD was forwarded")
+	}
+
+	recursive := newTestQuery(0x1234, "example.com", dnsmsg.A)
+	answered := exchangeTest(t, s, recursive)
+
+	want = createResponseMessage(recursive)
+	want.header.SetRA(1)
+	want.answer = []*RR{newTestRR("example.com", dnsmsg.A, 300, []byte{192, 0, 2, 1})}
+
+	assertMessage(t, want, answered)
+
+	// The TTL counts down while cached, it is not compared
+	response := exchangeTest(t, s, nonRecursive)
+	if response.header.RCODE() != dnsmsg.NOERROR || len(response.answer) != 1 || response.header.RD() != 0 {
+		t.Errorf("Expected the cached answer without RD, got:\n%s", strings.Join(messageLines(response), "\n"))
+	}
+
+	if stub.queries.Load() != 1 {
+		t.Errorf("Expected a single upstream query, got %d", stub.queries.Load())
+	}
+}
+
+// RFC-6761 - 6.4 - `.invalid` names never reach the resolver
+func TestSpecialUseInvalidNXDOMAIN(t *testing.T) {
+	stub := startStubResolver(t, answerA)
+	s := newTestServer(newTestForwarder(t, stub.addr))
+	s.specialUse = defaultSpecialUseTable()
+
+	query := newTestQuery(0x1234, "foo.invalid", dnsmsg.A)
+	response := exchangeTest(t, s, query)
+
+	want := createResponseMessage(query)
+	want.header.SetRA(1)
+	want.header.SetRCODE(dnsmsg.NXDOMAIN)
+
+	assertMessage(t, want, response)
+
+	if stub.queries.Load() != 0 {
+		t.Errorf("The .invalid name was forwarded")
+	}
+}
+
+// Only A and AAAA questions get the loopback address
+func TestSpecialUseLoopback(t *testing.T) {
+	s := newTestServer(nil)
+	s.specialUse = defaultSpecialUseTable()
+
+	for _, tc := range []struct {
+		qtype uint16
+		data  []byte
+	}{
+		{dnsmsg.A, []byte{127, 0, 0, 1}},
+		{dnsmsg.AAAA, []byte{15: 1}},
+		{dnsmsg.MX, nil},
+		{dnsmsg.TXT, nil},
+	} {
+		t.Run(dnsmsg.RRTypeName(tc.qtype), func(t *testing.T) {
+			query := newTestQuery(0x1234, "foo.localhost", tc.qtype)
+			response := exchangeTest(t, s, query)
+
+			want := createResponseMessage(query)
+			if tc.data != nil {
+				want.answer = []*RR{newTestRR("foo.localhost", tc.qtype, s.static.ttl, tc.data)}
+			}
+
+			assertMessage(t, want, response)
+		})
+	}
+}
+
+// RFC-1035 - 4.1.1 - The client matches the response to its query by ID,
+// the upstream query has an ID of its own
+func TestQueryIDEchoed(t *testing.T) {
+	stub := startStubResolver(t, answerA)
+
+	for _, tc := range []struct {
+		name string
+		s    *server
+	}{
+		{"static", newTestServer(nil)},
+		{"forwarded", newTestServer(newTestForwarder(t, stub.addr))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, id := range []uint16{0, 0xBEEF, 0xFFFF} {
+				response := exchangeTest(t, tc.s, newTestQuery(id, "example.com", dnsmsg.A))
+
+				if response.header.ID() != id || len(response.answer) != 1 {
+					t.Errorf("Expected ID %d with an answer, got ID %d with %d answers", id, response.header.ID(), len(response.answer))
+				}
+			}
+		})
+	}
+}
+
+// Every listener shares the forwarder and its cache
+func TestCacheSharedByUDPAndTCP(t *testing.T) {
+	stub := startStubResolver(t, answerA)
+
+	f := newTestForwarder(t, stub.addr)
+	f.cache = newAnswerCache(10, false)
+	s := newTestServer(f)
+
+	query := newTestQuery(0x1234, "example.com", dnsmsg.A)
+
+	exchangeTestOver(t, s, query, true)
+	response := exchangeTestOver(t, s, query, false)
+
+	if len(response.answer) != 1 || stub.queries.Load() != 1 {
+		t.Errorf("Expected the TCP query answered from the cache, got %d answers after %d upstream queries", len(response.answer), stub.queries.Load())
+	}
+}
+
+// CD goes from the client to the resolver, AD from the resolver to the
+// client. Z is never echoed.
+func TestADCDForwarded(t *testing.T) {
+	var upstreamCD atomic.Int32
+
+	stub := startStubResolver(t, func(query *message) *message {
+		upstreamCD.Store(int32(query.header.CD()))
+
+		response := answerA(query)
+		response.header.SetAD(1)
+		return response
+	})
+
+	s := newTestServer(newTestForwarder(t, stub.addr))
+
+	query := newTestQuery(0x1234, "example.com", dnsmsg.A)
+	query.header.SetCD(1)
+	query.header.SetZ(0b01000000)
+
+	response := exchangeTest(t, s, query)
+
+	if upstreamCD.Load() != 1 {
+		t.Errorf("CD not forwarded to the resolver")
+	}
+
+	if response.header.AD() != 1 || response.header.CD() != 1 || response.header[3]&0b01000000 != 0 {
+		t.Errorf("Expected ad=1 cd=1 z=0, got %08b", response.header[3])
+	}
+}
+
+// RFC-2308 - 2.2 - The SOA of a NODATA response is forwarded, so the client
+// can cache the absence of data
+func TestNODATAWithSOA(t *testing.T) {
+	soaRR := newTestRR("example.com", dnsmsg.SOA, 3600, nil)
+	err := setSOA(soaRR, &soa{
+		mname:   splitName("ns1.example.com"),
+		rname:   splitName("hostmaster.example.com"),
+		serial:  2024010101,
+		refresh: 7200,
+		retry:   900,
+		expire:  1209600,
+		minimum: 300,
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to build SOA: %v", err)
+	}
+
+	stub := startStubResolver(t, func(query *message) *message {
+		response := createResponseMessage(query)
+		response.header.SetRA(1)
+		response.authority = []*RR{soaRR}
+		response.header.SetNSCOUNT(1)
+		return response
+	})
+
+	s := newTestServer(newTestForwarder(t, stub.addr))
+
+	query := newTestQuery(0x1234, "example.com", dnsmsg.AAAA)
+	response := exchangeTest(t, s, query)
+
+	want := createResponseMessage(query)
+	want.header.SetRA(1)
+	want.authority = []*RR{soaRR}
+
+	assertMessage(t, want, response)
+}
+
+// RFC-6891 - 7 - A static answer to an EDNS query carries our OPT record,
+// advertising our payload size and echoing only the client cookie
+func TestStaticOPT(t *testing.T) {
+	s := newTestServer(nil)
+	s.ednsBufSize = 1400
+
+	clientCookie := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	serverCookie := []byte{9, 10, 11, 12, 13, 14, 15, 16}
+
+	opt := newOPT(4096)
+	opt.SetData(encodeEDNSOptions([]ednsOption{
+		{code: cookieOption, data: append(append([]byte{}, clientCookie...), serverCookie...)},
+	}))
+
+	query := newTestQuery(0x1234, "example.com", dnsmsg.A)
+	query.additional = []*RR{opt}
+	query.header.SetARCOUNT(1)
+
+	response := exchangeTest(t, s, query)
+
+	opts := response.opts()
+	if len(opts) != 1 {
+		t.Fatalf("Expected 1 OPT record, got %d", len(opts))
+	}
+
+	if size, _ := response.udpPayloadSize(); size != 1400 {
+		t.Errorf("Expected a payload size of 1400, got %d", size)
+	}
+
+	want := encodeEDNSOptions([]ednsOption{{code: cookieOption, data: clientCookie}})
+	if !bytes.Equal(opts[0].RDATA, want) {
+		t.Errorf("Expected RDATA %x, got %x", want, opts[0].RDATA)
+	}
+
+	if len(response.answer) != 1 {
+		t.Errorf("Expected the static answer, got %d answers", len(response.answer))
+	}
+}
+
+// RFC-1035 - 4.1.2 - The question is echoed as asked, QTYPE and QCLASS
+// included, whatever record we answer with
+func TestQuestionTypeEchoed(t *testing.T) {
+	s := newTestServer(nil)
+
+	query := newTestQuery(0x1234, "example.com", dnsmsg.MX)
+	response := exchangeTest(t, s, query)
+
+	if len(response.question) != 1 {
+		t.Fatalf("Expected 1 question, got %d", len(response.question))
+	}
+
+	if qtype := response.question[0].Type(); qtype != 15 {
+		t.Errorf("Expected QTYPE 15, got %d", qtype)
+	}
+
+	if qclass := response.question[0].Class(); qclass != dnsmsg.IN {
+		t.Errorf("Expected QCLASS %d, got %d", dnsmsg.IN, qclass)
+	}
+}
+
+// RFC-1035 - 4.1.1 - A query that was answered has RCODE 0
+func TestValidQueryNoError(t *testing.T) {
+	stub := startStubResolver(t, answerA)
+	s := newTestServer(newTestForwarder(t, stub.addr))
+
+	response := exchangeTest(t, s, newTestQuery(0x1234, "example.com", dnsmsg.A))
+
+	if response.header.RCODE() != dnsmsg.NOERROR {
+		t.Errorf("Expected RCODE %d, got %d", dnsmsg.NOERROR, response.header.RCODE())
+	}
+
+	if len(response.answer) != 1 {
+		t.Errorf("Expected 1 answer, got %d", len(response.answer))
+	}
+}
+
+// RFC-1035 - 4.1.1 - The OPCODE is echoed, STATUS is not implemented and
+// never forwarded
+func TestStatusOpcodeNotImplemented(t *testing.T) {
+	var forwarded atomic.Int32
+
+	stub := startStubResolver(t, func(query *message) *message {
+		forwarded.Add(1)
+		return answerA(query)
+	})
+
+	s := newTestServer(newTestForwarder(t, stub.addr))
+
+	query := newTestQuery(0x1234, "example.com", dnsmsg.A)
+	query.header.SetOPCODE(dnsmsg.STATUS)
+
+	response := exchangeTest(t, s, query)
+
+	want := createResponseMessage(query)
+	want.header.SetRCODE(dnsmsg.NOTIMP)
+
+	assertMessage(t, want, response)
+
+	if response.header.OPCODE() != dnsmsg.STATUS {
+		t.Errorf("Expected OPCODE %d, got %d", dnsmsg.STATUS, response.header.OPCODE())
+	}
+
+	if forwarded.Load() != 0 {
+		t.Errorf("A STATUS request was forwarded")
+	}
+}
+
+// RFC-1035 - 4.1.1 - A query without a question is a format error
+func TestNoQuestionFormErr(t *testing.T) {
+	var forwarded atomic.Int32
+
+	stub := startStubResolver(t, func(query *message) *message {
+		forwarded.Add(1)
+		return answerA(query)
+	})
+
+	s := newTestServer(newTestForwarder(t, stub.addr))
+
+	query := newTestQuery(0x1234, "example.com", dnsmsg.A)
+	query.question = nil
+	query.header.SetQDCOUNT(0)
+
+	response := exchangeTest(t, s, query)
+
+	want := createResponseMessage(query)
+	want.header.SetRCODE(dnsmsg.FORMERR)
+
+	assertMessage(t, want, response)
+
+	if forwarded.Load() != 0 {
+		t.Errorf("A query without a question was forwarded")
+	}
+}
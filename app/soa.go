@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+// RFC-1035 - 3.3.13 - SOA RDATA format
+type soa struct {
+	mname   []string
+	rname   []string
+	serial  uint32
+	refresh uint32
+	retry   uint32
+	expire  uint32
+	// RFC-2308 - 4 - The TTL of negative answers
+	minimum uint32
+}
+
+// `fixed` holds SERIAL, REFRESH, RETRY, EXPIRE & MINIMUM, 20 bytes
+func newSOA(mname []string, rname []string, fixed []byte) *soa {
+	return &soa{
+		mname:   mname,
+		rname:   rname,
+		serial:  binary.BigEndian.Uint32(fixed[0:4]),
+		refresh: binary.BigEndian.Uint32(fixed[4:8]),
+		retry:   binary.BigEndian.Uint32(fixed[8:12]),
+		expire:  binary.BigEndian.Uint32(fixed[12:16]),
+		minimum: binary.BigEndian.Uint32(fixed[16:20]),
+	}
+}
+
+func (s *soa) encode() ([]byte, error) {
+	data, err := dnsmsg.EncodeName(s.mname)
+	if err != nil {
+		return nil, err
+	}
+
+	rname, err := dnsmsg.EncodeName(s.rname)
+	if err != nil {
+		return nil, err
+	}
+
+	data = append(data, rname...)
+
+	for _, field := range []uint32{s.serial, s.refresh, s.retry, s.expire, s.minimum} {
+		data = binary.BigEndian.AppendUint32(data, field)
+	}
+
+	return data, nil
+}
+
+// The RDATA of records decoded from a frame is never compressed
+func rdataSOA(rr *RR) (*soa, bool) {
+	if rr.Type() != dnsmsg.SOA {
+		return nil, false
+	}
+
+	mname, head, ok := rdataLabels(rr.RDATA, 0)
+	if !ok {
+		return nil, false
+	}
+
+	rname, head, ok := rdataLabels(rr.RDATA, head)
+	if !ok || len(rr.RDATA)-head != 20 {
+		return nil, false
+	}
+
+	return newSOA(mname, rname, rr.RDATA[head:]), true
+}
+
+func setSOA(rr *RR, s *soa) error {
+	data, err := s.encode()
+	if err != nil {
+		return err
+	}
+
+	rr.SetType(dnsmsg.SOA)
+	rr.SetData(data)
+
+	return nil
+}
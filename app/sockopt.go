@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"syscall"
+)
+
+// Under high query rates the default kernel buffers of the listening socket
+// overflow, and packets get dropped before we even read them.
+// A zero size keeps the kernel default.
+type socketBuffers struct {
+	rcvbuf int
+	sndbuf int
+}
+
+// Meant for `net.ListenConfig.Control`, runs before the socket is bound
+func (b socketBuffers) control(network, address string, c syscall.RawConn) error {
+	var sockErr error
+
+	err := c.Control(func(fd uintptr) {
+		if b.rcvbuf > 0 {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, b.rcvbuf)
+			if sockErr != nil {
+				return
+			}
+		}
+
+		if b.sndbuf > 0 {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, b.sndbuf)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
+
+// The kernel is free to adjust what we asked for. Linux doubles it for its
+// own bookkeeping and clamps it to `net.core.rmem_max` / `wmem_max`.
+func (b socketBuffers) logGranted(conn *net.UDPConn) {
+	if b.rcvbuf == 0 && b.sndbuf == 0 {
+		return
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	var rcvbuf, sndbuf int
+
+	raw.Control(func(fd uintptr) {
+		rcvbuf, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		sndbuf, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	})
+
+	slog.Info("Socket buffers", "rcvbuf", rcvbuf, "requested_rcvbuf", b.rcvbuf, "sndbuf", sndbuf, "requested_sndbuf", b.sndbuf)
+}
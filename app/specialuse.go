@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+// RFC-6761 - Special-Use Domain Names
+// Some TLDs are reserved and must never reach the upstream resolver.
+// The table maps a TLD to what the forwarder does with names under it.
+type specialUseAction uint8
+
+const (
+	// Forward the question as any other name
+	specialUseForward specialUseAction = iota
+	// Immediately answer NXDOMAIN
+	specialUseNXDOMAIN
+	// Answer with the loopback address
+	specialUseLoopback
+	// Answer with the static answer, as if not in forwarder mode
+	specialUseStatic
+)
+
+var specialUseActionNames = map[string]specialUseAction{
+	"forward":  specialUseForward,
+	"nxdomain": specialUseNXDOMAIN,
+	"loopback": specialUseLoopback,
+	"static":   specialUseStatic,
+}
+
+type specialUseTable map[string]specialUseAction
+
+// See RFC-6761 - 6.2 to 6.5
+// `example` names are not special to caching servers, they are forwarded.
+func defaultSpecialUseTable() specialUseTable {
+	return specialUseTable{
+		"invalid":   specialUseNXDOMAIN,
+		"test":      specialUseNXDOMAIN,
+		"localhost": specialUseLoopback,
+		"example":   specialUseForward,
+	}
+}
+
+// Parses a `tld=action` entry, e.g. `test=static`
+func (t specialUseTable) set(entry string) error {
+	tld, actionName, found := strings.Cut(entry, "=")
+	if !found || tld == "" {
+		return fmt.Errorf("invalid special-use entry: %s", entry)
+	}
+
+	action, ok := specialUseActionNames[strings.ToLower(actionName)]
+	if !ok {
+		return fmt.Errorf("invalid special-use action: %s", actionName)
+	}
+
+	t[strings.ToLower(strings.Trim(tld, "."))] = action
+
+	return nil
+}
+
+func (t specialUseTable) lookup(name []string) specialUseAction {
+	if len(name) == 0 {
+		return specialUseForward
+	}
+
+	return t[strings.ToLower(name[len(name)-1])]
+}
+
+// Whether some names get the static answer even with a resolver
+func (t specialUseTable) answersStatic() bool {
+	for _, action := range t {
+		if action == specialUseStatic {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Answers the questions falling under a special-use TLD and returns the
+// questions that still have to be resolved.
+// When one of the questions is NXDOMAIN the whole response is NXDOMAIN, there
+// is only one RCODE per message.
+func (m *message) addSpecialUseAnswers(table specialUseTable, static *staticAnswer) ([]*question, error) {
+	remaining := make([]*question, 0, len(m.question))
+
+	for _, q := range m.question {
+		switch table.lookup(q.QNAME) {
+		case specialUseNXDOMAIN:
+			m.header.SetRCODE(dnsmsg.NXDOMAIN)
+		// RFC-6761 - 6.3 - Only address queries get the loopback, other
+		// types get an empty NOERROR as from the static answer
+		case specialUseLoopback:
+			switch q.Type() {
+			case dnsmsg.A:
+				m.addAnswer(q, netip.AddrFrom4([4]byte{127, 0, 0, 1}), static.ttl)
+			case dnsmsg.AAAA:
+				m.addAnswer(q, netip.IPv6Loopback(), static.ttl)
+			}
+		case specialUseStatic:
+			err := m.addStaticAnswer([]*question{q}, static)
+			if err != nil {
+				return remaining, err
+			}
+		default:
+			remaining = append(remaining, q)
+		}
+	}
+
+	return remaining, nil
+}
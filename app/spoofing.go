@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Replies from an upstream whose ID does not match the query we sent.
+// Every query has its own socket, so they are not late replies to other
+// queries. A steady stream of them may be an on-path attacker trying to
+// guess our IDs.
+const (
+	idMismatchWindow    = time.Minute
+	idMismatchThreshold = 10
+)
+
+type idMismatchCounter struct {
+	mu          sync.Mutex
+	upstream    net.Addr
+	total       uint64
+	windowStart time.Time
+	inWindow    uint64
+}
+
+func newIDMismatchCounter(upstream net.Addr) *idMismatchCounter {
+	return &idMismatchCounter{
+		upstream:    upstream,
+		windowStart: time.Now(),
+	}
+}
+
+func (c *idMismatchCounter) record() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(c.windowStart) >= idMismatchWindow {
+		c.windowStart = now
+		c.inWindow = 0
+	}
+
+	c.total++
+	c.inWindow++
+
+	// Once per window
+	if c.inWindow == idMismatchThreshold+1 {
+		slog.Warn("Many upstream replies with a mismatched ID, possible spoofing attempt",
+			"upstream", c.upstream, "mismatches", c.inWindow, "window", idMismatchWindow, "total", c.total)
+	}
+}
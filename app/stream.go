@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// RFC-7766 - 6.2.3 - Servers close connections left idle, so that clients
+// can't hold them open forever
+const streamIdleTimeout = 10 * time.Second
+
+// RFC-1035 - 4.2.2 - TCP usage
+// Over a stream, each message is prefixed by its length on two bytes.
+// A client may send several queries on the same connection.
+func (s *server) serveStream(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	// Unix socket clients have no address to count
+	var client netip.Addr
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		client = tcpAddr.AddrPort().Addr().Unmap()
+	}
+
+	for {
+		var length [2]byte
+
+		// A whole query must arrive within the idle timeout
+		conn.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+
+		_, err := io.ReadFull(reader, length[:])
+		if err != nil {
+			switch {
+			case errors.Is(err, io.EOF):
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				slog.Debug("Closing idle connection", "client", conn.RemoteAddr())
+			default:
+				slog.Error("Failed to receive data", "client", conn.RemoteAddr(), "err", err)
+			}
+			return
+		}
+
+		// Rather than draining an oversized query, drop the connection
+		size := int(binary.BigEndian.Uint16(length[:]))
+		if size > s.maxQuerySize {
+			slog.Warn("Query too large, closing the connection", "client", conn.RemoteAddr(), "size", size)
+			return
+		}
+
+		frame := make([]byte, size)
+
+		_, err = io.ReadFull(reader, frame)
+		if err != nil {
+			slog.Error("Failed to receive data", "client", conn.RemoteAddr(), "err", err)
+			return
+		}
+
+		if s.clients != nil && client.IsValid() {
+			s.clients.record(client)
+		}
+
+		serialized, _ := s.serveFrame(frame, conn.RemoteAddr(), false)
+		if serialized == nil {
+			continue
+		}
+
+		out := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(serialized)), uint16(len(serialized)))
+		out = append(out, serialized...)
+
+		_, err = conn.Write(out)
+		if err != nil {
+			slog.Error("Failed to send response", "client", conn.RemoteAddr(), "err", err)
+			return
+		}
+	}
+}
+
+func (s *server) serveStreamListener(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("Failed to accept connection", "err", err)
+			}
+			return
+		}
+
+		go s.serveStream(conn)
+	}
+}
+
+// A socket left behind by a previous run would make the bind fail.
+// Only remove the path when it is a socket, never a regular file.
+func listenUnix(path string) (*net.UnixListener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	addr, err := net.ResolveUnixAddr("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.ListenUnix("unix", addr)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+// Queries over TCP are counted per client, as over UDP
+func TestStreamClientsCounted(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := newTestServer(nil)
+	s.clients = newClientCounter(time.Minute, 0)
+	go s.serveStreamListener(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	frame, err := newTestQuery(1, "example.com", dnsmsg.A).serialize()
+	if err != nil {
+		t.Fatalf("Failed to serialize query: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(frame))))
+		conn.Write(frame)
+
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if _, err := io.ReadFull(conn, make([]byte, binary.BigEndian.Uint16(length[:]))); err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+	}
+
+	top := s.clients.top(1)
+	if len(top) != 1 || top[0].client != netip.MustParseAddr("127.0.0.1") || top[0].queries != 2 {
+		t.Fatalf("top clients = %v, want 127.0.0.1 with 2 queries", top)
+	}
+}
+
+// Framed as over TCP, RFC-1035 - 4.2.2
+func exchangeStream(conn net.Conn, query *message) (*message, error) {
+	frame, err := query.serialize()
+	if err != nil {
+		return nil, err
+	}
+
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(frame)))
+	if _, err := conn.Write(append(framed, frame...)); err != nil {
+		return nil, err
+	}
+
+	response, err := readStreamFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return deserialize(response)
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns.sock")
+
+	listener, err := listenUnix(path)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := newTestServer(nil)
+	go s.serveStreamListener(listener)
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// Several queries on the same connection
+	for id := uint16(1); id <= 2; id++ {
+		query := newTestQuery(id, "example.com", dnsmsg.A)
+
+		response, err := exchangeStream(conn, query)
+		if err != nil {
+			t.Fatalf("Failed to exchange: %v", err)
+		}
+
+		want := createResponseMessage(query)
+		want.answer = []*RR{newTestRR("example.com", dnsmsg.A, s.static.ttl, []byte{8, 8, 8, 8})}
+
+		assertMessage(t, want, response)
+	}
+}
+
+// A length prefix over `--max-query-size` closes the connection before the
+// query is read
+func TestStreamQueryTooLarge(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := newTestServer(nil)
+	s.maxQuerySize = 64
+	go s.serveStreamListener(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	query := newTestQuery(1, "example.com", dnsmsg.A)
+	query.question[0].QNAME = splitName(strings.Repeat("a.", 40) + "example.com")
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// EOF, or a reset when the unread query is still buffered
+	_, err = exchangeStream(conn, query)
+	if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected the connection closed, got %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+// RFC-9460 - 2.2 - SVCB RDATA wire format
+// SvcPriority, TargetName, then the SvcParams sorted by key.
+var svcParamKeys = map[string]uint16{
+	"mandatory":       0,
+	"alpn":            1,
+	"no-default-alpn": 2,
+	"port":            3,
+	"ipv4hint":        4,
+	"ipv6hint":        6,
+	// RFC-9461 - 5
+	"dohpath": 7,
+}
+
+// Encodes the presentation format of a SVCB record, without the owner name,
+// e.g. `1 dns.example.net alpn=dot,h2 port=853 dohpath=/dns-query{?dns}`
+func encodeSVCB(presentation string) ([]byte, error) {
+	fields := strings.Fields(presentation)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid SVCB record: %s", presentation)
+	}
+
+	priority, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SVCB priority: %s", fields[0])
+	}
+
+	target, err := dnsmsg.EncodeName(splitName(fields[1]))
+	if err != nil {
+		return nil, err
+	}
+
+	type param struct {
+		key   uint16
+		value []byte
+	}
+
+	params := make([]param, 0, len(fields)-2)
+
+	for _, field := range fields[2:] {
+		keyName, value, _ := strings.Cut(field, "=")
+
+		key, ok := svcParamKeys[keyName]
+		if !ok {
+			return nil, fmt.Errorf("unsupported SvcParamKey: %s", keyName)
+		}
+
+		encoded, err := encodeSvcParam(keyName, value)
+		if err != nil {
+			return nil, err
+		}
+
+		params = append(params, param{key: key, value: encoded})
+	}
+
+	sort.Slice(params, func(i, j int) bool {
+		return params[i].key < params[j].key
+	})
+
+	data := binary.BigEndian.AppendUint16(nil, uint16(priority))
+	data = append(data, target...)
+
+	for i, p := range params {
+		if i > 0 && params[i-1].key == p.key {
+			return nil, fmt.Errorf("duplicate SvcParamKey: %d", p.key)
+		}
+
+		data = binary.BigEndian.AppendUint16(data, p.key)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(p.value)))
+		data = append(data, p.value...)
+	}
+
+	return data, nil
+}
+
+func encodeSvcParam(key string, value string) ([]byte, error) {
+	encoded := make([]byte, 0)
+
+	switch key {
+	case "mandatory":
+		for _, name := range strings.Split(value, ",") {
+			code, ok := svcParamKeys[name]
+			if !ok {
+				return nil, fmt.Errorf("unsupported mandatory key: %s", name)
+			}
+			encoded = binary.BigEndian.AppendUint16(encoded, code)
+		}
+	case "alpn":
+		for _, id := range strings.Split(value, ",") {
+			if len(id) == 0 || len(id) > 255 {
+				return nil, fmt.Errorf("invalid alpn: %s", id)
+			}
+			encoded = append(encoded, byte(len(id)))
+			encoded = append(encoded, id...)
+		}
+	case "no-default-alpn":
+		if value != "" {
+			return nil, fmt.Errorf("no-default-alpn takes no value")
+		}
+	case "port":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port: %s", value)
+		}
+		encoded = binary.BigEndian.AppendUint16(encoded, uint16(port))
+	case "ipv4hint", "ipv6hint":
+		for _, addr := range strings.Split(value, ",") {
+			ip, err := netip.ParseAddr(addr)
+			if err != nil || ip.Is4() != (key == "ipv4hint") {
+				return nil, fmt.Errorf("invalid %s: %s", key, addr)
+			}
+			encoded = append(encoded, ip.AsSlice()...)
+		}
+	case "dohpath":
+		encoded = append(encoded, value...)
+	}
+
+	return encoded, nil
+}
+
+// RFC-9462 - 4 - Discovery of Designated Resolvers
+// Clients learn about our encrypted endpoints by asking for the SVCB
+// records of `_dns.resolver.arpa`.
+var dnrName = []string{"_dns", "resolver", "arpa"}
+
+func (m *message) isDNRQuery() bool {
+	if len(m.question) != 1 {
+		return false
+	}
+
+	q := m.question[0]
+
+	return strings.EqualFold(joinLabels(q.QNAME), joinLabels(dnrName)) && q.Type() == dnsmsg.SVCB && q.Class() == dnsmsg.IN
+}
+
+func (m *message) addDNRAnswers(records [][]byte) {
+	for _, data := range records {
+		answer := new(answer)
+
+		answer.NAME = dnrName
+		answer.SetType(dnsmsg.SVCB)
+		answer.SetClass(dnsmsg.IN)
+		// RFC-9462 - 4 - Matches the validity of the designation
+		answer.SetTTL(300)
+		answer.SetData(data)
+
+		m.answer = append(m.answer, answer)
+	}
+
+	m.header.SetANCOUNT(uint16(len(m.answer)))
+}
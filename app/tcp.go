@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// RFC-7766 - DNS over TCP to the resolver, `tcp://8.8.8.8`.
+// Framed as RFC-1035 - 4.2.2, as our own stream listeners.
+type tcpTransport struct {
+	// host:port
+	address string
+}
+
+// One connection per attempt, as with UDP
+func (t *tcpTransport) attempt(ctx context.Context, query *message, deadline time.Time, bufSize uint16, stats *metrics) (*message, error) {
+	sent := time.Now()
+
+	dialer := net.Dialer{Deadline: deadline}
+
+	conn, err := dialer.DialContext(ctx, "tcp", t.address)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to resolver: err = %w", err)
+	}
+	defer conn.Close()
+
+	return exchangeOverStream(ctx, conn, query, deadline, sent, "tcp://"+t.address, stats)
+}
+
+// A single query and its response on a connection, TCP or TLS
+func exchangeOverStream(ctx context.Context, conn net.Conn, query *message, deadline time.Time, sent time.Time, upstream string, stats *metrics) (*message, error) {
+	conn.SetDeadline(deadline)
+
+	serialized, err := query.serialize()
+	if err != nil {
+		return nil, err
+	}
+
+	framed := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(serialized)), uint16(len(serialized)))
+	framed = append(framed, serialized...)
+
+	_, err = conn.Write(framed)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to send query to resolver: err = %w", err)
+	}
+
+	trace(ctx, "Forwarded question", "questions", query.questionNames(), "upstream", upstream, "id", query.header.ID())
+
+	frame, err := readStreamFrame(conn)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, fmt.Errorf("Resolver did not answer within %s: err = %w", time.Since(sent).Round(time.Millisecond), err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read response from resolver: err = %w", err)
+	}
+
+	resolverResponse, err := deserialize(frame)
+	if err != nil {
+		stats.upstreamParseFailure()
+		return nil, fmt.Errorf("Failed to parse response from resolver")
+	}
+
+	// Frames can hardly be injected in a connection, a mismatch is a
+	// broken resolver rather than an attack
+	if resolverResponse.header.QR() != 1 || resolverResponse.header.ID() != query.header.ID() {
+		return nil, fmt.Errorf("Resolver answered with a frame that is not a response to our query")
+	}
+
+	return resolverResponse, nil
+}
+
+// A message prefixed by its length on two bytes
+func readStreamFrame(r io.Reader) ([]byte, error) {
+	var length [2]byte
+
+	_, err := io.ReadFull(r, length[:])
+	if err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, binary.BigEndian.Uint16(length[:]))
+
+	_, err = io.ReadFull(r, frame)
+	if err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
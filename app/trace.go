@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Tracing follows a single problematic lookup through the whole pipeline.
+// Queries for one of the traced names get a trace ID attached to their
+// context, and every step of their processing logs with that ID.
+type traceKey struct{}
+
+type traceNames map[string]bool
+
+func (t traceNames) add(name string) {
+	t[strings.ToLower(strings.Trim(name, "."))] = true
+}
+
+func (t traceNames) match(m *message) bool {
+	for _, q := range m.question {
+		if t[strings.ToLower(joinLabels(q.QNAME))] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func withTrace(ctx context.Context) context.Context {
+	return context.WithValue(ctx, traceKey{}, fmt.Sprintf("%016x", random.uint64()))
+}
+
+func traceID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(traceKey{}).(string)
+	return id, ok
+}
+
+// No-op for queries that are not traced
+func trace(ctx context.Context, msg string, args ...any) {
+	if _, ok := traceID(ctx); !ok {
+		return
+	}
+
+	slog.InfoContext(ctx, msg, args...)
+}
+
+// Wraps the handler of the default logger. Anything logged with the context
+// of a traced query carries its trace ID, warnings and errors included, not
+// only the lines of `trace`.
+type traceHandler struct {
+	slog.Handler
+}
+
+func (h traceHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, ok := traceID(ctx); ok {
+		r.AddAttrs(slog.String("trace", id))
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h traceHandler) WithGroup(name string) slog.Handler {
+	return traceHandler{h.Handler.WithGroup(name)}
+}
+
+func joinLabels(labels []string) string {
+	if len(labels) == 0 {
+		return "."
+	}
+
+	return strings.Join(labels, ".")
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+func TestTraceIDOnEveryLogLine(t *testing.T) {
+	var logs bytes.Buffer
+
+	saved := slog.Default()
+	slog.SetDefault(slog.New(traceHandler{slog.NewTextHandler(&logs, nil)}))
+	t.Cleanup(func() { slog.SetDefault(saved) })
+
+	ctx := withTrace(context.Background())
+	id, _ := traceID(ctx)
+
+	trace(ctx, "Traced step")
+	slog.WarnContext(ctx, "Failed to forward query")
+	slog.Default().With("client", "192.0.2.1").ErrorContext(ctx, "Failed to handle query")
+	logQuery(ctx, nil, createResponseMessage(newTestQuery(1, "example.com", dnsmsg.A)), 29)
+	slog.InfoContext(context.Background(), "Untraced query")
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("Expected 5 lines, got:\n%s", logs.String())
+	}
+
+	for _, line := range lines[:4] {
+		if strings.Count(line, "trace="+id) != 1 {
+			t.Errorf("Expected the trace ID %s once: %s", id, line)
+		}
+	}
+
+	if strings.Contains(lines[4], "trace=") {
+		t.Errorf("Trace ID on an untraced line: %s", lines[4])
+	}
+}
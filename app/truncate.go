@@ -0,0 +1,61 @@
+package main
+
+import "github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+
+// RFC-1035 - 4.2.1 - Messages carried by UDP are restricted to 512 bytes
+const maxUDPSize = 512
+
+// Serializes the message within `limit` bytes.
+// When it does not fit, records are dropped from the end of the message,
+// additional section first. RFC-2181 - 9 - TC is only set when answer or
+// authority records are dropped, the client can do without the glue.
+// The header and the question section are always kept whole, a client must
+// be able to match the truncated response to its query.
+func (m *message) serializeWithin(limit int, compress bool) ([]byte, error) {
+	serialized, err := dnsmsg.Append(nil, m.wire(), compress)
+	if err != nil {
+		return nil, err
+	}
+
+	for len(serialized) > limit {
+		// RFC-6891 - 7 - The OPT record is kept in truncated responses
+		droppable := lastNonOPT(m.additional)
+
+		switch {
+		case droppable >= 0:
+			m.additional = append(m.additional[:droppable], m.additional[droppable+1:]...)
+		case len(m.authority) > 0:
+			m.authority = m.authority[:len(m.authority)-1]
+			m.header.SetTC(1)
+		case len(m.answer) > 0:
+			m.answer = m.answer[:len(m.answer)-1]
+			m.header.SetTC(1)
+		default:
+			// Nothing left to drop, the question alone is too large
+			return serialized, nil
+		}
+
+		m.header.SetANCOUNT(uint16(len(m.answer)))
+		m.header.SetNSCOUNT(uint16(len(m.authority)))
+		m.header.SetARCOUNT(uint16(len(m.additional)))
+
+		// Each attempt is shorter than the previous one, its buffer is
+		// reused
+		serialized, err = dnsmsg.Append(serialized[:0], m.wire(), compress)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return serialized, nil
+}
+
+func lastNonOPT(rrs []*RR) int {
+	for i := len(rrs) - 1; i >= 0; i-- {
+		if rrs[i].Type() != dnsmsg.OPT {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+// RFC-2181 - 9 - The header and question survive truncation, TC is set
+func TestTruncateAnswers(t *testing.T) {
+	query := newTestQuery(0x1234, "many.example.com", dnsmsg.A)
+
+	response := createResponseMessage(query)
+	for i := 0; i < 100; i++ {
+		response.answer = append(response.answer, newTestRR("many.example.com", dnsmsg.A, 300, []byte{192, 0, 2, byte(i)}))
+	}
+	response.header.SetANCOUNT(uint16(len(response.answer)))
+
+	// Uncompressed, so that every record takes more room
+	serialized, err := response.serializeWithin(maxUDPSize, false)
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+
+	if len(serialized) > maxUDPSize {
+		t.Errorf("Response of %d bytes, more than %d", len(serialized), maxUDPSize)
+	}
+
+	parsed, err := deserialize(serialized)
+	if err != nil {
+		t.Fatalf("Failed to parse the truncated response: %v", err)
+	}
+
+	if parsed.header.TC() != 1 {
+		t.Errorf("TC not set")
+	}
+
+	if len(parsed.answer) == 0 || len(parsed.answer) >= 100 {
+		t.Errorf("Expected some of the answers to be dropped, got %d", len(parsed.answer))
+	}
+
+	want := createResponseMessage(query)
+	want.header.SetTC(1)
+	want.answer = response.answer[:len(parsed.answer)]
+
+	assertMessage(t, want, parsed)
+}
+
+// Dropping the glue alone does not send the client over TCP
+func TestTruncateGlueOnly(t *testing.T) {
+	hints, err := parseRootHints(namedRoot)
+	if err != nil {
+		t.Fatalf("Failed to parse root hints: %v", err)
+	}
+
+	query := newTestQuery(0x1234, ".", dnsmsg.NS)
+	query.header.SetRD(0)
+
+	response := createResponseMessage(query)
+	response.addRootHints(hints)
+	glue := len(response.additional)
+
+	serialized, err := response.serializeWithin(maxUDPSize, true)
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+
+	parsed, err := deserialize(serialized)
+	if err != nil {
+		t.Fatalf("Failed to parse the truncated response: %v", err)
+	}
+
+	if len(serialized) > maxUDPSize || len(parsed.additional) >= glue {
+		t.Fatalf("Expected some glue to be dropped within %d bytes, got %d bytes with %d glue records", maxUDPSize, len(serialized), len(parsed.additional))
+	}
+
+	if parsed.header.TC() != 0 || len(parsed.answer) != 13 {
+		t.Errorf("Expected the 13 NS records without TC, got %d with tc=%d", len(parsed.answer), parsed.header.TC())
+	}
+}
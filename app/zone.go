@@ -0,0 +1,354 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+// Records loaded with `--zone-file`, from a file in the master format of
+// RFC-1035 - 5. When set, we answer authoritatively from it instead of
+// giving the static answer.
+type zone struct {
+	// By lowercased name, then by type
+	records map[string]map[uint16][]*RR
+	// The A and AAAA records, added as glue for the targets of MX records
+	glue addressBook
+	// Every $ORIGIN of the file, lowercased. Names under none of them are
+	// not ours to answer. A file without $ORIGIN holds the whole tree.
+	origins [][]string
+}
+
+// CNAME records followed within the zone before giving up on a loop
+const maxCNAMEChain = 8
+
+// One entry of the file, with the lines within parentheses joined
+type zoneEntry struct {
+	line int
+	// RFC-1035 - 5.1 - An entry starting with a blank has the owner of the
+	// previous one
+	blankOwner bool
+	// Quoted strings are unquoted
+	tokens []string
+}
+
+func splitZoneEntries(data string) ([]zoneEntry, error) {
+	var entries []zoneEntry
+	var current zoneEntry
+	depth := 0
+
+	for n, line := range strings.Split(data, "\n") {
+		if depth == 0 {
+			current = zoneEntry{
+				line:       n + 1,
+				blankOwner: strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t"),
+			}
+		}
+
+		for i := 0; i < len(line); {
+			switch line[i] {
+			case ';':
+				i = len(line)
+			case ' ', '\t', '\r':
+				i++
+			case '(':
+				depth++
+				i++
+			case ')':
+				if depth == 0 {
+					return nil, fmt.Errorf("unbalanced parentheses on line %d", n+1)
+				}
+				depth--
+				i++
+			case '"':
+				end := strings.IndexByte(line[i+1:], '"')
+				if end < 0 {
+					return nil, fmt.Errorf("unterminated string on line %d", n+1)
+				}
+				current.tokens = append(current.tokens, line[i+1:i+1+end])
+				i += end + 2
+			default:
+				end := strings.IndexAny(line[i:], " \t\r;()\"")
+				if end < 0 {
+					end = len(line) - i
+				}
+				current.tokens = append(current.tokens, line[i:i+end])
+				i += end
+			}
+		}
+
+		if depth == 0 && len(current.tokens) > 0 {
+			entries = append(entries, current)
+		}
+	}
+
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced parentheses on line %d", current.line)
+	}
+
+	return entries, nil
+}
+
+// Names not ending with a dot are relative to the origin, `@` is the origin
+func absoluteName(name string, origin []string) []string {
+	if name == "@" {
+		return origin
+	}
+
+	if strings.HasSuffix(name, ".") {
+		return splitName(name)
+	}
+
+	return append(splitName(name), origin...)
+}
+
+// Supports the $ORIGIN and $TTL directives, see RFC-2308 - 4 for the
+// latter, and A, AAAA, CNAME, MX and TXT records of class IN.
+// Until a $TTL, records without a TTL get `ttl`.
+// Names are checked against the preferred name syntax unless `anyLabel`.
+func parseZone(data string, ttl uint32, anyLabel bool) (*zone, error) {
+	entries, err := splitZoneEntries(data)
+	if err != nil {
+		return nil, err
+	}
+
+	z := &zone{
+		records: make(map[string]map[uint16][]*RR),
+		glue:    make(addressBook),
+	}
+
+	origin := []string{}
+	var owner []string
+
+	for _, entry := range entries {
+		tokens := entry.tokens
+
+		switch strings.ToUpper(tokens[0]) {
+		case "$ORIGIN":
+			if len(tokens) != 2 {
+				return nil, fmt.Errorf("invalid $ORIGIN on line %d", entry.line)
+			}
+			origin = absoluteName(tokens[1], origin)
+			z.origins = append(z.origins, splitName(strings.ToLower(joinLabels(origin))))
+			continue
+		case "$TTL":
+			if len(tokens) != 2 {
+				return nil, fmt.Errorf("invalid $TTL on line %d", entry.line)
+			}
+			parsed, err := strconv.ParseUint(tokens[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid $TTL on line %d: %w", entry.line, err)
+			}
+			ttl = uint32(parsed)
+			continue
+		}
+
+		if !entry.blankOwner {
+			owner = absoluteName(tokens[0], origin)
+			tokens = tokens[1:]
+		} else if owner == nil {
+			return nil, fmt.Errorf("missing owner on line %d", entry.line)
+		}
+
+		rr := new(RR)
+		rr.NAME = owner
+		rr.SetClass(dnsmsg.IN)
+		rr.SetTTL(ttl)
+
+		// RFC-1035 - 5.1 - The TTL and the class come in any order
+		for len(tokens) > 0 {
+			if parsed, err := strconv.ParseUint(tokens[0], 10, 32); err == nil {
+				rr.SetTTL(uint32(parsed))
+			} else if class, ok := dnsmsg.ClassByName(tokens[0]); ok {
+				if class != dnsmsg.IN {
+					return nil, fmt.Errorf("unsupported class %s on line %d", tokens[0], entry.line)
+				}
+			} else {
+				break
+			}
+			tokens = tokens[1:]
+		}
+
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("missing type on line %d", entry.line)
+		}
+
+		err := setZoneRDATA(rr, tokens[0], tokens[1:], origin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s on line %d: %w", tokens[0], entry.line, err)
+		}
+
+		if !anyLabel {
+			err := checkZoneNames(rr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid name on line %d: %w", entry.line, err)
+			}
+		}
+
+		z.add(rr)
+	}
+
+	return z, nil
+}
+
+func setZoneRDATA(rr *RR, typeName string, fields []string, origin []string) error {
+	rrtype, _ := dnsmsg.RRTypeByName(typeName)
+
+	// TXT takes any number of strings
+	wantFields := map[uint16]int{dnsmsg.A: 1, dnsmsg.AAAA: 1, dnsmsg.CNAME: 1, dnsmsg.MX: 2}
+	if want, ok := wantFields[rrtype]; ok && len(fields) != want {
+		return fmt.Errorf("%d fields expected, got %d", want, len(fields))
+	}
+
+	switch rrtype {
+	case dnsmsg.A, dnsmsg.AAAA:
+		ip, err := netip.ParseAddr(fields[0])
+		if err != nil || ip.Is4() != (rrtype == dnsmsg.A) {
+			return fmt.Errorf("not an %s address", typeName)
+		}
+
+		rr.SetType(rrtype)
+		rr.SetData(ip.AsSlice())
+	case dnsmsg.CNAME:
+		return setCNAME(rr, absoluteName(fields[0], origin))
+	case dnsmsg.MX:
+		preference, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return err
+		}
+
+		return setMX(rr, uint16(preference), absoluteName(fields[1], origin))
+	case dnsmsg.TXT:
+		return setTXT(rr, fields)
+	default:
+		return fmt.Errorf("unsupported type")
+	}
+
+	return nil
+}
+
+// The owner, and the target of CNAME and MX records
+func checkZoneNames(rr *RR) error {
+	names := [][]string{rr.NAME}
+
+	if target, ok := rdataCNAME(rr); ok {
+		names = append(names, target)
+	}
+
+	if _, exchange, ok := rdataMX(rr); ok {
+		names = append(names, exchange)
+	}
+
+	for _, name := range names {
+		err := checkHostname(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (z *zone) add(rr *RR) {
+	name := strings.ToLower(joinLabels(rr.NAME))
+
+	byType, ok := z.records[name]
+	if !ok {
+		byType = make(map[uint16][]*RR)
+		z.records[name] = byType
+	}
+
+	byType[rr.Type()] = append(byType[rr.Type()], rr)
+
+	if rr.Type() == dnsmsg.A || rr.Type() == dnsmsg.AAAA {
+		z.glue.add(rr)
+	}
+}
+
+// Whether `name` is at or below one of the origins of the zone
+func (z *zone) contains(name []string) bool {
+	if len(z.origins) == 0 {
+		return true
+	}
+
+	for _, origin := range z.origins {
+		if len(name) < len(origin) {
+			continue
+		}
+
+		suffix := name[len(name)-len(origin):]
+		if slices.EqualFunc(suffix, origin, strings.EqualFold) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Answers as the authority of the zone: NXDOMAIN for names without records
+// and an empty NOERROR for names without records of the asked type.
+// Names outside of the zone are REFUSED, we have no authority over them.
+// CNAME records are followed within the zone, RFC-1034 - 4.3.2.
+// The addresses of the targets of the answers are added when the zone has
+// them, RFC-1035 - 3.3.9.
+func (m *message) addZoneAnswers(z *zone, questions []*question) {
+	m.header.SetAA(1)
+
+	for _, q := range questions {
+		if q.Class() != dnsmsg.IN {
+			m.header.SetRCODE(dnsmsg.NOTIMP)
+			continue
+		}
+
+		if !z.contains(q.QNAME) {
+			m.header.SetAA(0)
+			m.header.SetRCODE(dnsmsg.REFUSED)
+			continue
+		}
+
+		name := q.QNAME
+
+		for i := 0; i < maxCNAMEChain; i++ {
+			byType, ok := z.records[strings.ToLower(joinLabels(name))]
+			if !ok {
+				// Only the question itself, a CNAME may point out of the zone
+				if i == 0 {
+					m.header.SetRCODE(dnsmsg.NXDOMAIN)
+				}
+				break
+			}
+
+			if q.Type() == dnsmsg.ANY {
+				for _, rrs := range byType {
+					m.answer = append(m.answer, rrs...)
+				}
+				break
+			}
+
+			if rrs, ok := byType[q.Type()]; ok {
+				m.answer = append(m.answer, rrs...)
+				break
+			}
+
+			cnames, ok := byType[dnsmsg.CNAME]
+			if !ok {
+				break
+			}
+
+			m.answer = append(m.answer, cnames[0])
+
+			name, ok = rdataCNAME(cnames[0])
+			if !ok {
+				break
+			}
+		}
+	}
+
+	m.header.SetANCOUNT(uint16(len(m.answer)))
+
+	m.addGlue(z.glue)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+const testZone = `$ORIGIN example.com.
+$TTL 300
+@     MX 10 mail
+mail  A  192.0.2.25
+`
+
+func TestZoneMXGlue(t *testing.T) {
+	z, err := parseZone(testZone, 60, false)
+	if err != nil {
+		t.Fatalf("Failed to parse zone: %v", err)
+	}
+
+	s := newTestServer(nil)
+	s.zone = z
+
+	query := newTestQuery(0x1234, "example.com", dnsmsg.MX)
+	response := exchangeTest(t, s, query)
+
+	want := createResponseMessage(query)
+	want.header.SetAA(1)
+	want.answer = []*RR{newTestRR("example.com", dnsmsg.MX, 300, []byte("\x00\x0a\x04mail\x07example\x03com\x00"))}
+	want.additional = []*RR{newTestRR("mail.example.com", dnsmsg.A, 300, []byte{192, 0, 2, 25})}
+
+	assertMessage(t, want, response)
+}
+
+// Authoritative NXDOMAIN within the zone, REFUSED outside of it
+func TestZoneOrigin(t *testing.T) {
+	z, err := parseZone(testZone, 60, false)
+	if err != nil {
+		t.Fatalf("Failed to parse zone: %v", err)
+	}
+
+	s := newTestServer(nil)
+	s.zone = z
+
+	for _, tc := range []struct {
+		name  string
+		aa    uint8
+		rcode uint8
+	}{
+		{"missing.example.com", 1, dnsmsg.NXDOMAIN},
+		{"MAIL.Example.com", 1, dnsmsg.NOERROR},
+		{"example.org", 0, dnsmsg.REFUSED},
+		{"com", 0, dnsmsg.REFUSED},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			response := exchangeTest(t, s, newTestQuery(0x1234, tc.name, dnsmsg.AAAA))
+
+			if response.header.AA() != tc.aa || response.header.RCODE() != tc.rcode {
+				t.Errorf("Expected aa=%d rcode=%d, got aa=%d rcode=%d", tc.aa, tc.rcode, response.header.AA(), response.header.RCODE())
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package dnsmsg
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// Every distinct suffix costs an entry in the dictionary.
+// Past this many entries, new suffixes are written in full but still
+// reference the ones already known. It caps the memory spent per message
+// on adversarial upstream responses with thousands of distinct names.
+const maxCompressionEntries = 256
+
+// RFC-1035 - 4.1.4 - Message compression
+// Only used when serializing, see `appendCompressedName`.
+type labelCache struct {
+	// Map an encoded suffix to its position from the start of the message
+	labelMap map[string]int
+	// Where the message starts in the buffer it is appended to
+	start int
+	// The name being compressed, reused between names
+	scratch []byte
+}
+
+// Compression dictionaries, one per serialized message
+var labelCachePool = sync.Pool{
+	New: func() any { return &labelCache{labelMap: make(map[string]int)} },
+}
+
+func getLabelCache(start int) *labelCache {
+	cache := labelCachePool.Get().(*labelCache)
+	cache.start = start
+
+	return cache
+}
+
+func putLabelCache(cache *labelCache) {
+	clear(cache.labelMap)
+	labelCachePool.Put(cache)
+}
+
+// Names are written in full without a cache
+func appendMessageName(buf []byte, labels []string, cache *labelCache) ([]byte, error) {
+	if cache == nil {
+		return appendName(buf, labels)
+	}
+
+	return cache.appendCompressedName(buf, labels)
+}
+
+// Writes the labels of a name until one of its suffixes was already written
+// in the message, then a pointer to that suffix.
+// Suffixes are keyed by their wire encoding, matching is case sensitive so
+// the name the client reads back is byte for byte the one we were given.
+// Only owner names are compressed, RDATA is written as is.
+func (c *labelCache) appendCompressedName(buf []byte, labels []string) ([]byte, error) {
+	// Validates the length of the labels and of the whole name
+	encoded, err := appendName(c.scratch[:0], labels)
+	if err != nil {
+		return buf, err
+	}
+	c.scratch = encoded
+
+	for offset := 0; encoded[offset] != 0; offset += int(encoded[offset]) + 1 {
+		suffix := string(encoded[offset:])
+
+		if position, ok := c.labelMap[suffix]; ok {
+			return binary.BigEndian.AppendUint16(buf, 0xC000|uint16(position)), nil
+		}
+
+		// A pointer only has 14 bits for the offset
+		if position := len(buf) - c.start; position <= 0x3FFF && len(c.labelMap) < maxCompressionEntries {
+			c.labelMap[suffix] = position
+		}
+
+		buf = append(buf, encoded[offset:offset+int(encoded[offset])+1]...)
+	}
+
+	return append(buf, 0), nil
+}
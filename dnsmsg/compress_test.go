@@ -0,0 +1,47 @@
+package dnsmsg
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// Thousands of distinct names stop growing the dictionary past its cap,
+// the names past it are still written correctly
+func TestCompressionDictionaryBounded(t *testing.T) {
+	m := newTestMessage()
+	for i := 0; i < 2000; i++ {
+		m.Answer = append(m.Answer, newTestRR(fmt.Sprintf("host%d.example.com", i), A, 300, []byte{192, 0, 2, 1}))
+	}
+
+	cache := getLabelCache(0)
+	defer putLabelCache(cache)
+
+	buf := make([]byte, len(m.Header))
+	for _, rr := range m.Answer {
+		var err error
+
+		buf, err = cache.appendCompressedName(buf, rr.NAME)
+		if err != nil {
+			t.Fatalf("Failed to compress %v: %v", rr.NAME, err)
+		}
+	}
+
+	if len(cache.labelMap) > maxCompressionEntries {
+		t.Errorf("Dictionary of %d entries, more than %d", len(cache.labelMap), maxCompressionEntries)
+	}
+
+	frame, err := MarshalCompressed(m)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+
+	var parsed Message
+	if err := Unmarshal(frame, &parsed); err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+
+	if !reflect.DeepEqual(m, &parsed) {
+		t.Errorf("The names past the dictionary cap were not written back whole")
+	}
+}
@@ -0,0 +1,75 @@
+package dnsmsg_test
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dnsmsg"
+)
+
+// A query for the address of codecrafters.io, recursion desired
+func ExampleMarshal() {
+	q := &dnsmsg.Question{QNAME: []string{"codecrafters", "io"}}
+	q.SetType(dnsmsg.A)
+	q.SetClass(dnsmsg.IN)
+
+	m := &dnsmsg.Message{Header: new(dnsmsg.Header), Question: []*dnsmsg.Question{q}}
+	m.Header.SetID(0x1234)
+	m.Header.SetRD(1)
+
+	frame, err := dnsmsg.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("% x\n", frame)
+	// Output:
+	// 12 34 01 00 00 01 00 00 00 00 00 00 0c 63 6f 64 65 63 72 61 66 74 65 72 73 02 69 6f 00 00 01 00 01
+}
+
+// The owner of the answer is a pointer to the question name
+func ExampleUnmarshal() {
+	frame := []byte{
+		0x12, 0x34, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0,
+		12, 'c', 'o', 'd', 'e', 'c', 'r', 'a', 'f', 't', 'e', 'r', 's', 2, 'i', 'o', 0, 0, 1, 0, 1,
+		0xC0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 76, 76, 21, 21,
+	}
+
+	var m dnsmsg.Message
+	if err := dnsmsg.Unmarshal(frame, &m); err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("id=%#x rcode=%d\n", m.Header.ID(), m.Header.RCODE())
+
+	for _, rr := range m.Answer {
+		addr, _ := netip.AddrFromSlice(rr.RDATA)
+		fmt.Println(strings.Join(rr.NAME, "."), rr.TTLSeconds(), dnsmsg.ClassName(rr.Class()), dnsmsg.RRTypeName(rr.Type()), addr)
+	}
+	// Output:
+	// id=0x1234 rcode=0
+	// codecrafters.io 60 IN A 76.76.21.21
+}
+
+// Names already written are replaced by pointers, the answer owner here
+func ExampleMarshalCompressed() {
+	q := &dnsmsg.Question{QNAME: []string{"codecrafters", "io"}}
+	q.SetType(dnsmsg.A)
+	q.SetClass(dnsmsg.IN)
+
+	rr := &dnsmsg.RR{NAME: q.QNAME}
+	rr.SetType(dnsmsg.A)
+	rr.SetClass(dnsmsg.IN)
+	rr.SetTTL(60)
+	rr.SetData([]byte{76, 76, 21, 21})
+
+	m := &dnsmsg.Message{Header: new(dnsmsg.Header), Question: []*dnsmsg.Question{q}, Answer: []*dnsmsg.RR{rr}}
+
+	full, _ := dnsmsg.Marshal(m)
+	compressed, _ := dnsmsg.MarshalCompressed(m)
+
+	fmt.Println(len(full), len(compressed))
+	// Output:
+	// 64 49
+}
@@ -0,0 +1,144 @@
+package dnsmsg
+
+import "encoding/binary"
+
+// OPCODES
+// RFC-1034 and RFC-1035 only specify 3 OPCODEs: 0 QUERY, 1 IQUERY, and 2 STATUS.
+// It reserves 3-15 for future use.
+const (
+	QUERY  uint8 = 0
+	IQUERY uint8 = 1
+	STATUS uint8 = 2
+)
+
+// RCODES, RFC-1035 - 4.1.1
+const (
+	NOERROR  uint8 = 0
+	FORMERR  uint8 = 1
+	SERVFAIL uint8 = 2
+	NXDOMAIN uint8 = 3
+	// The name server does not support the requested kind of query
+	NOTIMP  uint8 = 4
+	REFUSED uint8 = 5
+)
+
+// RFC 1035 - 4.1.1 - Header section format, as it is on the wire
+type Header [12]byte
+
+func (h *Header) SetID(id uint16) {
+	binary.BigEndian.PutUint16(h[0:2], id)
+}
+
+func (h *Header) ID() uint16 {
+	return binary.BigEndian.Uint16(h[0:2])
+}
+
+func (h *Header) SetQR(isReply uint8) {
+	h[2] = (h[2] & 0b01111111) | (isReply&1)<<7
+}
+
+func (h *Header) QR() uint8 {
+	return (h[2] & 0b10000000) >> 7
+}
+
+func (h *Header) OPCODE() uint8 {
+	return (h[2] & 0b01111000) >> 3
+}
+
+func (h *Header) SetOPCODE(op uint8) {
+	h[2] = (h[2] & 0b10000111) | (op&0b00001111)<<3
+}
+
+func (h *Header) SetAA(isAuthoritativeAnswer uint8) {
+	h[2] = (h[2] & 0b11111011) | (isAuthoritativeAnswer&1)<<2
+}
+
+func (h *Header) AA() uint8 {
+	return (h[2] & 0b00000100) >> 2
+}
+
+func (h *Header) SetTC(isTruncated uint8) {
+	h[2] = (h[2] & 0b11111101) | (isTruncated&1)<<1
+}
+
+func (h *Header) TC() uint8 {
+	return (h[2] & 0b00000010) >> 1
+}
+
+func (h *Header) SetRD(recursionDesired uint8) {
+	h[2] = (h[2] & 0b11111110) | (recursionDesired & 1)
+}
+
+func (h *Header) RD() uint8 {
+	return h[2] & 0b00000001
+}
+
+func (h *Header) RA() uint8 {
+	return (h[3] & 0b10000000) >> 7
+}
+
+func (h *Header) SetRA(recursionAvailable uint8) {
+	h[3] = (h[3] & 0b01111111) | (recursionAvailable&1)<<7
+}
+
+// RFC-1035 defines Z as bits 4-6 of byte 3, RFC-4035 - 3.2 reassigns the
+// two low ones to AD and CD. Z is only the top one now.
+func (h *Header) SetZ(val uint8) {
+	h[3] = (h[3] & 0b10111111) | (val & 0b01000000)
+}
+
+func (h *Header) AD() uint8 {
+	return (h[3] & 0b00100000) >> 5
+}
+
+func (h *Header) SetAD(authenticData uint8) {
+	h[3] = (h[3] & 0b11011111) | (authenticData&1)<<5
+}
+
+func (h *Header) CD() uint8 {
+	return (h[3] & 0b00010000) >> 4
+}
+
+func (h *Header) SetCD(checkingDisabled uint8) {
+	h[3] = (h[3] & 0b11101111) | (checkingDisabled&1)<<4
+}
+
+func (h *Header) RCODE() uint8 {
+	return h[3] & 0b00001111
+}
+
+func (h *Header) SetRCODE(code uint8) {
+	h[3] = (h[3] & 0b11110000) | (code & 0b00001111)
+}
+
+func (h *Header) SetQDCOUNT(count uint16) {
+	binary.BigEndian.PutUint16(h[4:6], count)
+}
+
+func (h *Header) QDCOUNT() uint16 {
+	return binary.BigEndian.Uint16(h[4:6])
+}
+
+func (h *Header) SetANCOUNT(count uint16) {
+	binary.BigEndian.PutUint16(h[6:8], count)
+}
+
+func (h *Header) ANCOUNT() uint16 {
+	return binary.BigEndian.Uint16(h[6:8])
+}
+
+func (h *Header) SetNSCOUNT(count uint16) {
+	binary.BigEndian.PutUint16(h[8:10], count)
+}
+
+func (h *Header) NSCOUNT() uint16 {
+	return binary.BigEndian.Uint16(h[8:10])
+}
+
+func (h *Header) SetARCOUNT(count uint16) {
+	binary.BigEndian.PutUint16(h[10:12], count)
+}
+
+func (h *Header) ARCOUNT() uint16 {
+	return binary.BigEndian.Uint16(h[10:12])
+}
@@ -0,0 +1,48 @@
+package dnsmsg
+
+import "testing"
+
+// RFC-4035 - 3.2 - Z is bit 6 of the fourth header byte, AD bit 5, CD bit 4
+func TestHeaderADCDZBits(t *testing.T) {
+	h := new(Header)
+
+	h.SetAD(1)
+	h.SetCD(1)
+	if h[3] != 0b00110000 {
+		t.Errorf("Expected AD and CD on bits 5 and 4, got %08b", h[3])
+	}
+
+	h.SetZ(0b01000000)
+	if h[3] != 0b01110000 {
+		t.Errorf("Expected Z on bit 6, got %08b", h[3])
+	}
+
+	h.SetZ(0)
+	if h.AD() != 1 || h.CD() != 1 || h[3] != 0b00110000 {
+		t.Errorf("Clearing Z disturbed AD or CD: %08b", h[3])
+	}
+}
+
+// OPCODE takes bits 3-6 of byte 2, between QR and AA
+func TestHeaderOPCODE(t *testing.T) {
+	h := new(Header)
+	h.SetQR(1)
+	h.SetAA(1)
+
+	for op := uint8(0); op < 16; op++ {
+		h.SetOPCODE(op)
+
+		if h.OPCODE() != op {
+			t.Errorf("Expected OPCODE %d, got %d", op, h.OPCODE())
+		}
+
+		if h.QR() != 1 || h.AA() != 1 {
+			t.Errorf("Setting OPCODE %d disturbed QR or AA: %08b", op, h[2])
+		}
+	}
+
+	h.SetOPCODE(STATUS)
+	if h[2] != 0b10010100 {
+		t.Errorf("Expected STATUS on bits 3-6, got %08b", h[2])
+	}
+}
@@ -0,0 +1,369 @@
+// Package dnsmsg reads and writes DNS messages in their wire format, see
+// RFC-1035 - 4.
+//
+// Names are kept as their labels, `www.example.com` is
+// `[]string{"www", "example", "com"}` and the root has none. Compressed
+// names are followed when reading, RDATA holding names included, so a
+// decoded record can be written in any other message.
+package dnsmsg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+// RFC-1035 - 4.1 - Message format
+type Message struct {
+	Header     *Header
+	Question   []*Question
+	Answer     []*RR
+	Authority  []*RR
+	Additional []*RR
+}
+
+// RFC 1035 - 4.1.2 - Question section format
+type Question struct {
+	QNAME  []string
+	QTYPE  [2]byte
+	QCLASS [2]byte
+}
+
+// Encoded length, the name written in full
+func (q *Question) Len() int {
+	return encodedNameLen(q.QNAME) + 4
+}
+
+func (q *Question) Type() uint16 {
+	return binary.BigEndian.Uint16(q.QTYPE[:])
+}
+
+func (q *Question) Class() uint16 {
+	return binary.BigEndian.Uint16(q.QCLASS[:])
+}
+
+func (q *Question) SetType(t uint16) {
+	binary.BigEndian.PutUint16(q.QTYPE[:], t)
+}
+
+func (q *Question) SetClass(c uint16) {
+	binary.BigEndian.PutUint16(q.QCLASS[:], c)
+}
+
+// RFC 1035 - 4.1.3 - RR format
+type RR struct {
+	NAME     []string
+	TYPE     [2]byte
+	CLASS    [2]byte
+	TTL      [4]byte
+	RDLENGTH [2]byte
+	RDATA    []byte
+}
+
+// Encoded length, the name written in full: TYPE, CLASS, TTL and RDLENGTH
+// take 10 bytes
+func (rr *RR) Len() int {
+	return encodedNameLen(rr.NAME) + 10 + len(rr.RDATA)
+}
+
+func (rr *RR) Type() uint16 {
+	return binary.BigEndian.Uint16(rr.TYPE[:])
+}
+
+func (rr *RR) Class() uint16 {
+	return binary.BigEndian.Uint16(rr.CLASS[:])
+}
+
+func (rr *RR) TTLSeconds() uint32 {
+	return binary.BigEndian.Uint32(rr.TTL[:])
+}
+
+func (rr *RR) SetType(t uint16) {
+	binary.BigEndian.PutUint16(rr.TYPE[:], t)
+}
+
+func (rr *RR) SetClass(c uint16) {
+	binary.BigEndian.PutUint16(rr.CLASS[:], c)
+}
+
+func (rr *RR) SetTTL(ttl uint32) {
+	binary.BigEndian.PutUint32(rr.TTL[:], ttl)
+}
+
+// Also sets RDLENGTH
+func (rr *RR) SetData(data []byte) {
+	binary.BigEndian.PutUint16(rr.RDLENGTH[:], uint16(len(data)))
+	rr.RDATA = data
+}
+
+// Parses `frame` into `m`. The RDATA of records without names to
+// decompress is a slice of `frame`, which must not be modified afterwards.
+func Unmarshal(frame []byte, m *Message) error {
+	// HEADER
+	header := new(Header)
+	copied := copy(header[:], frame)
+
+	if copied < 12 {
+		return fmt.Errorf("invalid DNS header")
+	}
+
+	// QUESTION
+	head := 12
+	questions := make([]*Question, 0, boundedCount(header.QDCOUNT(), len(frame)-head, minQuestionLen))
+
+	for i := uint16(0); i < header.QDCOUNT(); i++ {
+		question := new(Question)
+
+		labels, err := DecodeName(frame, &head)
+
+		if err != nil {
+			return err
+		}
+
+		question.QNAME = labels
+
+		question.QTYPE, _, err = extractUint16(frame, &head)
+		if err != nil {
+			return err
+		}
+
+		question.QCLASS, _, err = extractUint16(frame, &head)
+		if err != nil {
+			return err
+		}
+
+		questions = append(questions, question)
+	}
+
+	// ANSWER
+	answers, err := decodeRRs(frame, &head, header.ANCOUNT())
+	if err != nil {
+		return err
+	}
+
+	// AUTHORITY
+	authority, err := decodeRRs(frame, &head, header.NSCOUNT())
+	if err != nil {
+		return err
+	}
+
+	// ADDITIONAL
+	additional, err := decodeRRs(frame, &head, header.ARCOUNT())
+	if err != nil {
+		return err
+	}
+
+	*m = Message{
+		Header:     header,
+		Question:   questions,
+		Answer:     answers,
+		Authority:  authority,
+		Additional: additional,
+	}
+
+	return nil
+}
+
+// The message with every name written in full
+func Marshal(m *Message) ([]byte, error) {
+	return Append(nil, m, false)
+}
+
+// RFC-1035 - 4.1.4 - Message compression
+// The message with owner names pointing to the names written before them.
+func MarshalCompressed(m *Message) ([]byte, error) {
+	return Append(nil, m, true)
+}
+
+// Appends the message to `buf`, with its names compressed when `compress`
+// is set. Pointers are offsets from the start of the message, not of `buf`.
+// The counts of the header are set to the length of the sections.
+func Append(buf []byte, m *Message, compress bool) ([]byte, error) {
+	var cache *labelCache
+	if compress {
+		cache = getLabelCache(len(buf))
+		defer putLabelCache(cache)
+	}
+
+	buf = slices.Grow(buf, m.Len())
+
+	// The counts always describe the sections we actually write
+	m.Header.SetQDCOUNT(uint16(len(m.Question)))
+	m.Header.SetANCOUNT(uint16(len(m.Answer)))
+	m.Header.SetNSCOUNT(uint16(len(m.Authority)))
+	m.Header.SetARCOUNT(uint16(len(m.Additional)))
+
+	buf = append(buf, m.Header[:]...)
+
+	var err error
+
+	for _, q := range m.Question {
+		buf, err = appendMessageName(buf, q.QNAME, cache)
+		if err != nil {
+			return buf, err
+		}
+
+		buf = append(buf, q.QTYPE[:]...)
+		buf = append(buf, q.QCLASS[:]...)
+	}
+
+	for _, section := range [][]*RR{m.Answer, m.Authority, m.Additional} {
+		for _, rr := range section {
+			buf, err = appendMessageName(buf, rr.NAME, cache)
+			if err != nil {
+				return buf, err
+			}
+
+			buf = append(buf, rr.TYPE[:]...)
+			buf = append(buf, rr.CLASS[:]...)
+			buf = append(buf, rr.TTL[:]...)
+			// RDATA with names is re-encoded, the RDLENGTH read from the
+			// wire does not necessarily match it anymore
+			if len(rr.RDATA) > 0xFFFF {
+				return buf, fmt.Errorf("RDATA too long: %d bytes", len(rr.RDATA))
+			}
+
+			buf = binary.BigEndian.AppendUint16(buf, uint16(len(rr.RDATA)))
+			buf = append(buf, rr.RDATA...)
+		}
+	}
+
+	return buf, nil
+}
+
+// Encoded length, every name written in full
+func (m *Message) Len() int {
+	total := len(m.Header)
+
+	for _, q := range m.Question {
+		total += q.Len()
+	}
+
+	for _, section := range [][]*RR{m.Answer, m.Authority, m.Additional} {
+		for _, rr := range section {
+			total += rr.Len()
+		}
+	}
+
+	return total
+}
+
+// The smallest question and record: the root name then their fixed fields
+const (
+	minQuestionLen = 1 + 4
+	minRRLen       = 1 + 10
+)
+
+// The counts of the header are whatever the sender claims, the frame may
+// hold far fewer entries. Never preallocate more than it could.
+func boundedCount(count uint16, remaining int, minLen int) int {
+	return min(int(count), max(remaining, 0)/minLen)
+}
+
+func decodeRRs(frame []byte, head *int, count uint16) ([]*RR, error) {
+	rrs := make([]*RR, 0, boundedCount(count, len(frame)-*head, minRRLen))
+
+	for i := uint16(0); i < count; i++ {
+		rr := new(RR)
+
+		labels, err := DecodeName(frame, head)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var rdLength uint16
+
+		rr.NAME = labels
+
+		// TYPE, CLASS, TTL & RDLENGTH
+		fixed, err := extractBytes(frame, head, 10)
+		if err != nil {
+			return nil, err
+		}
+
+		copy(rr.TYPE[:], fixed[0:2])
+		copy(rr.CLASS[:], fixed[2:4])
+		copy(rr.TTL[:], fixed[4:8])
+		copy(rr.RDLENGTH[:], fixed[8:10])
+		rdLength = binary.BigEndian.Uint16(rr.RDLENGTH[:])
+
+		switch rr.Type() {
+		case SOA:
+			data, err := decodeSOA(frame, head, int(rdLength))
+			if err != nil {
+				return nil, err
+			}
+
+			rr.SetData(data)
+		case CNAME, NS, PTR:
+			data, err := decodeNameRDATA(frame, head, int(rdLength))
+			if err != nil {
+				return nil, err
+			}
+
+			rr.SetData(data)
+		// RFC-1035 - 3.3.9 - PREFERENCE then EXCHANGE
+		case MX:
+			data, err := decodePrefixedName(frame, head, int(rdLength), 2)
+			if err != nil {
+				return nil, err
+			}
+
+			rr.SetData(data)
+		// RFC-2782 - Priority, Weight & Port then Target.
+		// It must not be compressed, RFC-3597 - 4 still asks receivers to
+		// decompress it.
+		case SRV:
+			data, err := decodePrefixedName(frame, head, int(rdLength), 6)
+			if err != nil {
+				return nil, err
+			}
+
+			rr.SetData(data)
+		case CAA:
+			rr.RDATA, err = extractBytes(frame, head, int(rdLength))
+			if err != nil {
+				return nil, err
+			}
+
+			err = checkCAA(rr.RDATA)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			rr.RDATA, err = extractBytes(frame, head, int(rdLength))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		rrs = append(rrs, rr)
+	}
+
+	return rrs, nil
+}
+
+// TODO replace by making use of bufio.reader
+// no nead to maintain our own head / offset
+func extractBytes(src []byte, offset *int, length int) ([]byte, error) {
+	if length < 0 || *offset+length > len(src) {
+		return nil, fmt.Errorf("Frame too short: %d bytes needed at offset %d, frame is %d bytes", length, *offset, len(src))
+	}
+
+	result := src[*offset : *offset+length]
+	*offset += length
+	return result, nil
+}
+
+func extractUint16(src []byte, offset *int) ([2]byte, uint16, error) {
+	var result [2]byte
+
+	data, err := extractBytes(src, offset, 2)
+	if err != nil {
+		return result, 0, err
+	}
+
+	copy(result[:], data)
+	return result, binary.BigEndian.Uint16(result[:]), nil
+}
@@ -0,0 +1,249 @@
+package dnsmsg
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// A header for a frame with `qdcount` questions and `ancount` answers
+func testFrameHeader(qdcount byte, ancount byte) []byte {
+	return []byte{0x12, 0x34, 0x81, 0x80, 0, qdcount, 0, ancount, 0, 0, 0, 0}
+}
+
+// The root is "" and has no label
+func newTestRR(name string, rrtype uint16, ttl uint32, data []byte) *RR {
+	rr := &RR{NAME: []string{}}
+	if name != "" {
+		rr.NAME = strings.Split(name, ".")
+	}
+
+	rr.SetType(rrtype)
+	rr.SetClass(IN)
+	rr.SetTTL(ttl)
+	rr.SetData(data)
+
+	return rr
+}
+
+// www.example.com A, answered by a CNAME and an address
+func newTestMessage() *Message {
+	q := &Question{QNAME: []string{"www", "example", "com"}}
+	q.SetType(A)
+	q.SetClass(IN)
+
+	m := &Message{Header: new(Header), Question: []*Question{q}}
+	m.Header.SetID(0x1234)
+	m.Header.SetQR(1)
+	m.Answer = []*RR{
+		newTestRR("www.example.com", CNAME, 300, []byte("\x03cdn\x07example\x03com\x00")),
+		newTestRR("cdn.example.com", A, 60, []byte{192, 0, 2, 1}),
+	}
+	m.Authority = []*RR{}
+	m.Additional = []*RR{}
+
+	return m
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	m := newTestMessage()
+
+	for _, marshal := range []func(*Message) ([]byte, error){Marshal, MarshalCompressed} {
+		frame, err := marshal(m)
+		if err != nil {
+			t.Fatalf("Failed to marshal: %v", err)
+		}
+
+		var parsed Message
+		if err := Unmarshal(frame, &parsed); err != nil {
+			t.Fatalf("Failed to unmarshal: %v", err)
+		}
+
+		if !reflect.DeepEqual(m, &parsed) {
+			t.Errorf("Expected %+v, got %+v", m, &parsed)
+		}
+	}
+}
+
+// Pointers are offsets from the start of the message, whatever `buf`
+// already holds. A stream transport prefixes the message with its length.
+func TestAppendAfterPrefix(t *testing.T) {
+	m := newTestMessage()
+
+	want, err := MarshalCompressed(m)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+
+	prefix := []byte{0, byte(len(want))}
+
+	got, err := Append(slices.Clone(prefix), m, true)
+	if err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+
+	if !bytes.Equal(got, append(prefix, want...)) {
+		t.Errorf("Expected %x, got %x", append(prefix, want...), got)
+	}
+}
+
+// MNAME and RNAME are decompressed, the RDATA can be written in another
+// message
+func TestDecodeCompressedSOA(t *testing.T) {
+	fixed := []byte{0, 0, 0, 1, 0, 0, 0x1C, 0x20, 0, 0, 0x03, 0x84, 0, 0x12, 0x75, 0, 0, 0, 0x01, 0x2C}
+
+	frame := testFrameHeader(1, 1)
+	frame = append(frame, "\x07example\x03com\x00\x00\x06\x00\x01"...)
+	frame = append(frame, 0xC0, 12, 0, byte(SOA), 0, 1, 0, 0, 0x0E, 0x10, 0, 39)
+	frame = append(frame, "\x03ns1\xC0\x0C\x0Ahostmaster\xC0\x0C"...)
+	frame = append(frame, fixed...)
+
+	var m Message
+	if err := Unmarshal(frame, &m); err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+
+	want := append([]byte("\x03ns1\x07example\x03com\x00\x0Ahostmaster\x07example\x03com\x00"), fixed...)
+	if !bytes.Equal(m.Answer[0].RDATA, want) {
+		t.Errorf("Expected RDATA %x, got %x", want, m.Answer[0].RDATA)
+	}
+
+	if rdLength := int(m.Answer[0].RDLENGTH[0])<<8 | int(m.Answer[0].RDLENGTH[1]); rdLength != len(want) {
+		t.Errorf("Expected RDLENGTH %d, got %d", len(want), rdLength)
+	}
+}
+
+// RFC-1035 - 3.1 - A name is at most 255 bytes, counting the part reached
+// through a pointer
+func TestDecodeNameTooLong(t *testing.T) {
+	label := func(n int) []byte {
+		return append([]byte{byte(n)}, strings.Repeat("a", n)...)
+	}
+
+	// 3 labels of 63 bytes and the root, 193 bytes
+	suffix := slices.Concat(label(63), label(63), label(63), []byte{0})
+
+	for _, tc := range []struct {
+		name   string
+		prefix []byte
+		// Whether `suffix` is reached through a pointer or repeated inline
+		pointer bool
+		valid   bool
+	}{
+		{"255 bytes", label(61), true, true},
+		{"256 bytes", label(62), true, false},
+		{"321 bytes inline", slices.Concat(label(63), label(63)), false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			frame := testFrameHeader(0, 0)
+			frame = append(frame, suffix...)
+
+			head := len(frame)
+			frame = append(frame, tc.prefix...)
+			if tc.pointer {
+				frame = append(frame, 0xC0, 12)
+			} else {
+				frame = append(frame, suffix...)
+			}
+
+			labels, err := DecodeName(frame, &head)
+			if tc.valid && err != nil {
+				t.Errorf("Failed to decode a %s name: %v", tc.name, err)
+			}
+
+			if !tc.valid && err == nil {
+				t.Errorf("Expected a %d bytes name to be rejected", encodedNameLen(labels))
+			}
+		})
+	}
+}
+
+func TestDecodePointerLoops(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		qname []byte
+	}{
+		// The question name is a pointer to itself
+		{"self", []byte{0xC0, 12}},
+		{"forward", []byte{0xC0, 14, 0}},
+		// A label, then a pointer back to that label
+		{"back to its own labels", []byte{1, 'a', 0xC0, 12}},
+		// Two pointers to each other, the second one past the first
+		{"two pointers", []byte{0xC0, 14, 0xC0, 12}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			frame := append(testFrameHeader(1, 0), tc.qname...)
+			frame = append(frame, 0, 1, 0, 1)
+
+			err := Unmarshal(frame, new(Message))
+			if err == nil {
+				t.Errorf("Parsed a frame with a pointer loop")
+			}
+		})
+	}
+}
+
+func TestUnmarshalRandomFrames(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+
+	for i := 0; i < 10000; i++ {
+		frame := make([]byte, r.IntN(64))
+		for j := range frame {
+			frame[j] = byte(r.UintN(256))
+		}
+
+		// Claim questions and records the frame is too short to hold
+		if len(frame) >= 12 {
+			frame[5] = byte(r.UintN(4))
+			frame[7] = byte(r.UintN(4))
+		}
+
+		Unmarshal(frame, new(Message))
+	}
+}
+
+// A bare header claiming 65535 entries in every section
+func TestUnmarshalBoundsAllocations(t *testing.T) {
+	frame := []byte{0x12, 0x34, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	err := Unmarshal(frame, new(Message))
+
+	runtime.ReadMemStats(&after)
+
+	if err == nil {
+		t.Errorf("Parsed a frame without its questions")
+	}
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 4096 {
+		t.Errorf("Allocated %d bytes for a 12 bytes frame", allocated)
+	}
+}
+
+// RR.Len() is the encoded name, the 10 fixed bytes and the RDATA, as it
+// is written uncompressed
+func TestRRLen(t *testing.T) {
+	for _, rr := range []*RR{
+		newTestRR("", OPT, 0, []byte{}),
+		newTestRR("www.example.com", A, 300, []byte{192, 0, 2, 1}),
+		newTestRR("example.com", TXT, 300, []byte("\x0bv=spf1 -all")),
+		newTestRR(strings.Repeat("a.", 100)+"example.com", AAAA, 300, make([]byte, 16)),
+	} {
+		m := &Message{Header: new(Header), Answer: []*RR{rr}}
+
+		frame, err := Marshal(m)
+		if err != nil {
+			t.Fatalf("Failed to marshal: %v", err)
+		}
+
+		if written := len(frame) - len(m.Header); rr.Len() != written {
+			t.Errorf("Expected %d bytes for %s %s, got %d", written, strings.Join(rr.NAME, "."), RRTypeName(rr.Type()), rr.Len())
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package dnsmsg
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// See QNAME & NAME definitions in RFC-1035 - 4.1.2 as well as 2.3.1.
+// The labels are written in full, never compressed.
+func EncodeName(labels []string) ([]byte, error) {
+	return appendName(make([]byte, 0), labels)
+}
+
+// Appends the encoded labels to `buf`, which is returned unchanged on error
+func appendName(buf []byte, labels []string) ([]byte, error) {
+	start := len(buf)
+
+	for _, label := range labels {
+		if len(label) > 63 {
+			return buf[:start],
+				fmt.Errorf("Max len of a label is 63.")
+		}
+
+		// Note: the labels are written in full here, see
+		// `appendCompressedName` for compression
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+
+	buf = append(buf, byte(0))
+
+	if len(buf)-start > maxNameLen {
+		return buf[:start], fmt.Errorf("Max len of a label seq is 255.")
+	}
+
+	return buf, nil
+}
+
+// Length of the labels once encoded, each after its length byte, and the
+// root byte
+func encodedNameLen(labels []string) int {
+	total := 1
+	for _, label := range labels {
+		total += len(label) + 1
+	}
+
+	return total
+}
+
+// RFC-1035 - 3.1 - A name is at most 255 bytes, and each label takes at
+// least 2 of them, its length and one character.
+// Decoding past this many labels means we are going in circles.
+const maxLabels = 127
+
+// Encoded length of a name: every label with its length byte, then the root
+const maxNameLen = 255
+
+// RFC-1035 - 4.1.4 - A name ends with the root label, or with a pointer to
+// the rest of the name elsewhere in the frame, which may itself end with a
+// pointer. Pointers are followed in the frame, `head` is left after the
+// first one.
+func DecodeName(frame []byte, head *int) ([]string, error) {
+	labels := make([]string, 0)
+	// The root byte, counted from the start
+	nameLen := 1
+
+	offset := *head
+	// Start of the labels being read, the next pointer must point before
+	// it. Each jump goes further back, loops cannot be built.
+	segment := offset
+	jumped := false
+
+	for {
+		if offset >= len(frame) {
+			return labels, fmt.Errorf("Frame too short: label sequence not terminated at offset %d", offset)
+		}
+
+		if frame[offset] == 0 {
+			offset++
+			break
+		}
+
+		// The two high bits flag a pointer, the remaining 14 bits are the
+		// offset of the referenced label from the start of the frame.
+		if frame[offset]&0b11000000 == 0b11000000 {
+			if offset+2 > len(frame) {
+				return labels, fmt.Errorf("Frame too short: truncated label reference at offset %d", offset)
+			}
+
+			pointer := int(binary.BigEndian.Uint16(frame[offset:offset+2]) & 0x3FFF)
+
+			// RFC-1035 - 4.1.4 - A pointer refers to a prior occurrence of
+			// the name. Pointing to itself or further ahead is how loops are
+			// built.
+			if pointer >= segment {
+				return labels, fmt.Errorf("Invalid label reference: %d does not point backwards from %d", pointer, segment)
+			}
+
+			if !jumped {
+				*head = offset + 2
+				jumped = true
+			}
+
+			offset = pointer
+			segment = pointer
+			continue
+		}
+
+		// The 0b01 and 0b10 prefixes are reserved, a label is at most 63 bytes
+		if frame[offset] > 63 {
+			return labels, fmt.Errorf("Invalid label length %d at offset %d", frame[offset], offset)
+		}
+
+		labelLen := int(frame[offset])
+		labelPosition := offset
+		offset++
+
+		data, err := extractBytes(frame, &offset, labelLen)
+		if err != nil {
+			return labels, err
+		}
+
+		labels = append(labels, string(data))
+
+		nameLen += labelLen + 1
+		if nameLen > maxNameLen {
+			return labels, fmt.Errorf("Name too long: more than %d bytes at offset %d", maxNameLen, labelPosition)
+		}
+
+		if len(labels) > maxLabels {
+			return labels, fmt.Errorf("Too many labels: more than %d", maxLabels)
+		}
+	}
+
+	if !jumped {
+		*head = offset
+	}
+
+	return labels, nil
+}
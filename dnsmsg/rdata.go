@@ -0,0 +1,103 @@
+package dnsmsg
+
+import "fmt"
+
+// RFC-1035 - 3.3.1 - CNAME RDATA format
+// The RDATA is a single name, as for NS (3.3.11) and PTR (3.3.12).
+// Like for SOA, the name is decompressed so the RDATA can be written in any
+// message.
+func decodeNameRDATA(frame []byte, head *int, rdLength int) ([]byte, error) {
+	start := *head
+
+	name, err := DecodeName(frame, head)
+	if err != nil {
+		return nil, err
+	}
+
+	if *head-start != rdLength {
+		return nil, fmt.Errorf("Invalid RDATA length: %d, the name takes %d bytes", rdLength, *head-start)
+	}
+
+	return EncodeName(name)
+}
+
+// RDATA made of fixed size fields followed by a name, which may be
+// compressed
+func decodePrefixedName(frame []byte, head *int, rdLength int, prefixLen int) ([]byte, error) {
+	if rdLength <= prefixLen {
+		return nil, fmt.Errorf("Invalid RDATA length: %d", rdLength)
+	}
+
+	prefix, err := extractBytes(frame, head, prefixLen)
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := decodeNameRDATA(frame, head, rdLength-prefixLen)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append([]byte{}, prefix...), name...), nil
+}
+
+// RFC-1035 - 3.3.13 - SOA RDATA format
+// MNAME and RNAME may be compressed, and the pointers only make sense in the
+// frame they come from. They are decompressed so the RDATA can be written in
+// any message.
+func decodeSOA(frame []byte, head *int, rdLength int) ([]byte, error) {
+	start := *head
+
+	mname, err := DecodeName(frame, head)
+	if err != nil {
+		return nil, err
+	}
+
+	rname, err := DecodeName(frame, head)
+	if err != nil {
+		return nil, err
+	}
+
+	// SERIAL, REFRESH, RETRY, EXPIRE & MINIMUM
+	if start+rdLength-*head != 20 {
+		return nil, fmt.Errorf("Invalid SOA RDATA length: %d", rdLength)
+	}
+
+	fixed, err := extractBytes(frame, head, 20)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := EncodeName(mname)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = appendName(data, rname)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(data, fixed...), nil
+}
+
+// RFC-8659 - 4.1 - CAA RDATA format
+// There is no name to decompress, only the tag length to check against the
+// RDATA. The value takes whatever is left.
+func checkCAA(data []byte) error {
+	if len(data) < 2 {
+		return fmt.Errorf("Invalid CAA RDATA length: %d", len(data))
+	}
+
+	tagLength := int(data[1])
+
+	if tagLength == 0 {
+		return fmt.Errorf("Invalid CAA tag: empty")
+	}
+
+	if 2+tagLength > len(data) {
+		return fmt.Errorf("Invalid CAA tag length: %d, RDATA is %d bytes", tagLength, len(data))
+	}
+
+	return nil
+}
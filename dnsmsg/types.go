@@ -0,0 +1,138 @@
+package dnsmsg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// TYPES
+// See RFC-1035 - 3.2.2 & 3.2.3 and the IANA "Resource Record (RR) TYPEs"
+// registry for the later ones.
+const (
+	A     uint16 = 1
+	NS    uint16 = 2
+	CNAME uint16 = 5
+	SOA   uint16 = 6
+	PTR   uint16 = 12
+	HINFO uint16 = 13
+	MX    uint16 = 15
+	TXT   uint16 = 16
+	AAAA  uint16 = 28
+	SRV   uint16 = 33
+	NAPTR uint16 = 35
+	// RFC-6891 - EDNS0 pseudo-RR
+	OPT    uint16 = 41
+	DS     uint16 = 43
+	RRSIG  uint16 = 46
+	NSEC   uint16 = 47
+	DNSKEY uint16 = 48
+	SVCB   uint16 = 64
+	HTTPS  uint16 = 65
+	// RFC-1995 - Incremental zone transfer
+	IXFR uint16 = 251
+	// RFC-5936 - Full zone transfer
+	AXFR uint16 = 252
+	ANY  uint16 = 255
+	CAA  uint16 = 257
+)
+
+// CLASSES
+const (
+	IN uint16 = 1
+	CH uint16 = 3
+	HS uint16 = 4
+)
+
+var rrTypeNames = map[uint16]string{
+	A:      "A",
+	NS:     "NS",
+	CNAME:  "CNAME",
+	SOA:    "SOA",
+	PTR:    "PTR",
+	HINFO:  "HINFO",
+	MX:     "MX",
+	TXT:    "TXT",
+	AAAA:   "AAAA",
+	SRV:    "SRV",
+	NAPTR:  "NAPTR",
+	OPT:    "OPT",
+	DS:     "DS",
+	RRSIG:  "RRSIG",
+	NSEC:   "NSEC",
+	DNSKEY: "DNSKEY",
+	SVCB:   "SVCB",
+	HTTPS:  "HTTPS",
+	IXFR:   "IXFR",
+	AXFR:   "AXFR",
+	ANY:    "ANY",
+	CAA:    "CAA",
+}
+
+var classNames = map[uint16]string{
+	IN: "IN",
+	CH: "CH",
+	HS: "HS",
+}
+
+var rrTypesByName = invert(rrTypeNames)
+var classesByName = invert(classNames)
+
+func invert(names map[uint16]string) map[string]uint16 {
+	codes := make(map[string]uint16, len(names))
+
+	for code, name := range names {
+		codes[name] = code
+	}
+
+	return codes
+}
+
+// RFC-3597 - 5 - Unknown types are written `TYPE<code>`
+func RRTypeName(t uint16) string {
+	if name, ok := rrTypeNames[t]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+// Whether the type is one of the constants above
+func KnownRRType(t uint16) bool {
+	_, ok := rrTypeNames[t]
+	return ok
+}
+
+func RRTypeByName(name string) (uint16, bool) {
+	return byName(name, "TYPE", rrTypesByName)
+}
+
+// RFC-3597 - 5 - Unknown classes are written `CLASS<code>`
+func ClassName(c uint16) string {
+	if name, ok := classNames[c]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("CLASS%d", c)
+}
+
+func ClassByName(name string) (uint16, bool) {
+	return byName(name, "CLASS", classesByName)
+}
+
+func byName(name string, genericPrefix string, codes map[string]uint16) (uint16, bool) {
+	name = strings.ToUpper(name)
+
+	if code, ok := codes[name]; ok {
+		return code, true
+	}
+
+	if generic, found := strings.CutPrefix(name, genericPrefix); found {
+		code, err := strconv.ParseUint(generic, 10, 16)
+		if err == nil {
+			return uint16(code), true
+		}
+	}
+
+	return 0, false
+}
@@ -9,3 +9,7 @@
 module github.com/codecrafters-io/dns-server-starter-go
 
 go 1.22
+
+require golang.org/x/net v0.30.0
+
+require golang.org/x/sys v0.26.0 // indirect